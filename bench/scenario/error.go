@@ -131,7 +131,12 @@ func errorBadResponse(res *http.Response, message string, args ...interface{}) e
 }
 
 func errorFormatWithResponse(res *http.Response, message string, args ...interface{}) error {
-	return errorFormatWithURI(res.StatusCode, res.Request.Method, res.Request.URL.RequestURI(), message, args...)
+	err := errorFormatWithURI(res.StatusCode, res.Request.Method, res.Request.URL.RequestURI(), message, args...)
+	// webapp のログと突き合わせられるよう、レスポンスにリクエストIDがあれば付ける
+	if requestID := res.Header.Get("X-Request-ID"); requestID != "" {
+		return fmt.Errorf("%w [request_id: %s]", err, requestID)
+	}
+	return err
 }
 func errorFormatWithURI(statusCode int, method string, urlPath string, message string, args ...interface{}) error {
 	args = append(args, statusCode, method, urlPath)
@@ -580,8 +580,15 @@ func verifyGraph(
 					return errorInvalid(res, "condition_timestampsがstart_atからend_atの中に収まっていません")
 				}
 
-				// graphOne.ConditionTimestamps の要素が古い順に並んでいることの検証
+				// graphOne.ConditionTimestamps に同じ時刻が重複していないことの検証
+				// (重複は下の整列順の検証でも弾かれるが、重複した行が書き込まれたことが分かるよう別のエラーにする)
 				nowSort := model.IsuConditionCursor{TimestampUnix: timestamp}
+				if idxTimestamps != len(graphOne.ConditionTimestamps)-1 && nowSort.TimestampUnix == lastSort.TimestampUnix {
+					logger.AdminLogger.Printf("duplicated timestamp: %v", timestamp)
+					return errorMismatch(res, "condition_timestampsに重複した時刻が含まれています")
+				}
+
+				// graphOne.ConditionTimestamps の要素が古い順に並んでいることの検証
 				if idxTimestamps != len(graphOne.ConditionTimestamps)-1 && !nowSort.Less(&lastSort) {
 					return errorInvalid(res, "整列順が正しくありません")
 				}
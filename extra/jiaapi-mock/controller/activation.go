@@ -51,6 +51,10 @@ type ActivationRequest struct {
 	IsuUUID       string `json:"isu_uuid" validate:"required"`
 }
 
+type DeactivationRequest struct {
+	IsuUUID string `json:"isu_uuid" validate:"required"`
+}
+
 /// Controller ///
 
 type ActivationController struct {
@@ -89,3 +93,19 @@ func (c *ActivationController) PostActivate(ctx echo.Context) error {
 
 	return ctx.JSON(http.StatusAccepted, isuState)
 }
+
+func (c *ActivationController) PostDeactivate(ctx echo.Context) error {
+	req := &DeactivationRequest{}
+	err := ctx.Bind(req)
+	if err != nil {
+		ctx.Logger().Errorf("failed to bind: %v", err)
+		return ctx.String(http.StatusBadRequest, "Bad Request")
+	}
+
+	if !c.isuConditionPosterManager.StopPosting(req.IsuUUID) {
+		ctx.Logger().Errorf("not activated isu_uuid: %v", req.IsuUUID)
+		return ctx.String(http.StatusNotFound, "Bad isu_uuid")
+	}
+
+	return ctx.NoContent(http.StatusNoContent)
+}
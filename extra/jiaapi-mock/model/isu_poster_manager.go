@@ -31,3 +31,15 @@ func (m *IsuConditionPosterManager) StartPosting(targetURL *url.URL, isuUUID str
 	}
 	return nil
 }
+
+func (m *IsuConditionPosterManager) StopPosting(isuUUID string) bool {
+	m.activatedIsuMtx.Lock()
+	defer m.activatedIsuMtx.Unlock()
+	isu, ok := m.activatedIsu[isuUUID]
+	if !ok {
+		return false
+	}
+	isu.StopPosting()
+	delete(m.activatedIsu, isuUUID)
+	return true
+}
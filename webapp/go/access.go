@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	isuRoleOwner  = "owner"
+	isuRoleEditor = "editor"
+	isuRoleViewer = "viewer"
+
+	isuAccessInvitationTTL = 7 * 24 * time.Hour
+)
+
+// 権限の強さ。強い権限は弱い権限でできることを全てできる
+var isuRoleRanks = map[string]int{
+	isuRoleViewer: 1,
+	isuRoleEditor: 2,
+	isuRoleOwner:  3,
+}
+
+// ISUを利用できるユーザーとその権限
+type IsuAccess struct {
+	JIAIsuUUID string    `db:"jia_isu_uuid" json:"jia_isu_uuid"`
+	JIAUserID  string    `db:"jia_user_id" json:"jia_user_id"`
+	Role       string    `db:"role" json:"role"`
+	CreatedAt  time.Time `db:"created_at" json:"-"`
+}
+
+// ISUを共有するための招待。一度だけ受け入れられる
+type IsuAccessInvitation struct {
+	Token      string         `db:"token"`
+	JIAIsuUUID string         `db:"jia_isu_uuid"`
+	Role       string         `db:"role"`
+	InvitedBy  string         `db:"invited_by"`
+	AcceptedBy sql.NullString `db:"accepted_by"`
+	ExpiresAt  time.Time      `db:"expires_at"`
+	CreatedAt  time.Time      `db:"created_at"`
+}
+
+type PostIsuAccessInvitationRequest struct {
+	Role string `json:"role"`
+}
+
+type PostIsuAccessInvitationResponse struct {
+	Token      string `json:"token"`
+	JIAIsuUUID string `json:"jia_isu_uuid"`
+	Role       string `json:"role"`
+	ExpiresAt  int64  `json:"expires_at"`
+}
+
+// ISUに対するユーザーの権限を確認する。
+// 権限が無い場合は404、必要な権限に足りない場合は403のステータスコードとエラーを返す
+func authorizeIsu(q sqlx.Queryer, jiaUserID string, jiaIsuUUID string, required string) (string, int, error) {
+	var role string
+	err := sqlx.Get(q, &role, "SELECT `role` FROM `isu_access` WHERE `jia_isu_uuid` = ? AND `jia_user_id` = ?",
+		jiaIsuUUID, jiaUserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", http.StatusNotFound, fmt.Errorf("not found: isu")
+		}
+		return "", http.StatusInternalServerError, fmt.Errorf("db error: %v", err)
+	}
+	if isuRoleRanks[role] < isuRoleRanks[required] {
+		return role, http.StatusForbidden, fmt.Errorf("forbidden")
+	}
+	return role, http.StatusOK, nil
+}
+
+// 全てのISUを利用できるか確認する
+func canAccessIsus(jiaUserID string, jiaIsuUUIDs []string) (bool, error) {
+	unique := map[string]struct{}{}
+	for _, jiaIsuUUID := range jiaIsuUUIDs {
+		unique[jiaIsuUUID] = struct{}{}
+	}
+	if len(unique) == 0 {
+		return true, nil
+	}
+
+	query, args, err := sqlx.In("SELECT COUNT(*) FROM `isu_access` WHERE `jia_user_id` = ? AND `jia_isu_uuid` IN (?)",
+		jiaUserID, jiaIsuUUIDs)
+	if err != nil {
+		return false, err
+	}
+	var count int
+	err = db.Get(&count, query, args...)
+	if err != nil {
+		return false, fmt.Errorf("db error: %v", err)
+	}
+	return count == len(unique), nil
+}
+
+func newInvitationToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// GET /api/isu/:jia_isu_uuid/access
+// ISUを利用できるユーザーの一覧を取得
+func getIsuAccessList(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	_, errStatusCode, err = authorizeIsu(db, jiaUserID, jiaIsuUUID, isuRoleOwner)
+	if err != nil {
+		if errStatusCode == http.StatusNotFound {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, "forbidden")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	accessList := []IsuAccess{}
+	err = db.Select(&accessList, "SELECT * FROM `isu_access` WHERE `jia_isu_uuid` = ? ORDER BY `created_at`, `jia_user_id`",
+		jiaIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, accessList)
+}
+
+// POST /api/isu/:jia_isu_uuid/access/invitation
+// ISUを共有するための招待を作成
+func postIsuAccessInvitation(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+
+	var req PostIsuAccessInvitationRequest
+	err = c.Bind(&req)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	// 所有者は一人だけなので、招待できるのは編集者と閲覧者のみ
+	if req.Role != isuRoleEditor && req.Role != isuRoleViewer {
+		return c.String(http.StatusBadRequest, "bad format: role")
+	}
+
+	_, errStatusCode, err = authorizeIsu(db, jiaUserID, jiaIsuUUID, isuRoleOwner)
+	if err != nil {
+		if errStatusCode == http.StatusNotFound {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, "forbidden")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	token, err := newInvitationToken()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	expiresAt := time.Now().Add(isuAccessInvitationTTL)
+
+	_, err = db.Exec("INSERT INTO `isu_access_invitation`"+
+		"	(`token`, `jia_isu_uuid`, `role`, `invited_by`, `expires_at`) VALUES (?, ?, ?, ?, ?)",
+		token, jiaIsuUUID, req.Role, jiaUserID, expiresAt)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusCreated, PostIsuAccessInvitationResponse{
+		Token:      token,
+		JIAIsuUUID: jiaIsuUUID,
+		Role:       req.Role,
+		ExpiresAt:  expiresAt.Unix(),
+	})
+}
+
+// POST /api/invitation/:token/accept
+// 招待を受け入れ、ISUを利用できるようにする
+func postIsuAccessInvitationAccept(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var invitation IsuAccessInvitation
+	err = tx.Get(&invitation, "SELECT * FROM `isu_access_invitation` WHERE `token` = ? FOR UPDATE", c.Param("token"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: invitation")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if invitation.AcceptedBy.Valid || invitation.ExpiresAt.Before(time.Now()) {
+		return c.String(http.StatusGone, "invitation expired")
+	}
+
+	role, errStatusCode, err := authorizeIsu(tx, jiaUserID, invitation.JIAIsuUUID, isuRoleViewer)
+	if err != nil && errStatusCode != http.StatusNotFound {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	// 既に招待より強い権限を持つ場合は、権限を弱めない
+	if isuRoleRanks[role] < isuRoleRanks[invitation.Role] {
+		_, err = tx.Exec("INSERT INTO `isu_access` (`jia_isu_uuid`, `jia_user_id`, `role`) VALUES (?, ?, ?)"+
+			"	ON DUPLICATE KEY UPDATE `role` = VALUES(`role`)",
+			invitation.JIAIsuUUID, jiaUserID, invitation.Role)
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	_, err = tx.Exec("UPDATE `isu_access_invitation` SET `accepted_by` = ? WHERE `token` = ?", jiaUserID, invitation.Token)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var access IsuAccess
+	err = tx.Get(&access, "SELECT * FROM `isu_access` WHERE `jia_isu_uuid` = ? AND `jia_user_id` = ?",
+		invitation.JIAIsuUUID, jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, access)
+}
+
+// DELETE /api/isu/:jia_isu_uuid/access/:jia_user_id
+// ユーザーがISUを利用できないようにする。所有者以外は自分の権限のみ削除できる
+func deleteIsuAccess(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	targetUserID := c.Param("jia_user_id")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	required := isuRoleOwner
+	if targetUserID == jiaUserID {
+		required = isuRoleViewer
+	}
+	role, errStatusCode, err := authorizeIsu(tx, jiaUserID, jiaIsuUUID, required)
+	if err != nil {
+		if errStatusCode == http.StatusNotFound {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, "forbidden")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	// 所有者の権限を外すにはISUの登録を解除する
+	if targetUserID == jiaUserID && role == isuRoleOwner {
+		return c.String(http.StatusBadRequest, "owner cannot leave isu")
+	}
+
+	result, err := tx.Exec("DELETE FROM `isu_access` WHERE `jia_isu_uuid` = ? AND `jia_user_id` = ?", jiaIsuUUID, targetUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if affected == 0 {
+		return c.String(http.StatusNotFound, "not found: access")
+	}
+
+	// 利用できなくなったISUはそのユーザーのグループから外す
+	_, err = tx.Exec("DELETE `m` FROM `isu_group_member` AS `m` JOIN `isu_group` AS `g` ON `m`.`group_id` = `g`.`id`"+
+		"	WHERE `g`.`jia_user_id` = ? AND `m`.`jia_isu_uuid` = ?",
+		targetUserID, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	conditionHub.RevokeAccess(jiaIsuUUID, targetUserID)
+
+	return c.NoContent(http.StatusNoContent)
+}
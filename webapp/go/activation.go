@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	isuActivationPending = "pending"
+	isuActivationActive  = "active"
+	isuActivationFailed  = "failed"
+
+	// syncではPOST /api/isuの中でactivateし、asyncではバックグラウンドでactivateする
+	isuActivationModeSync  = "sync"
+	isuActivationModeAsync = "async"
+
+	activationQueueCapacity = 1000
+	activationWorkerCount   = 4
+	activationMaxRounds     = 5
+	activationRetryInterval = time.Second
+)
+
+var errActivationQueueFull = errors.New("activation queue is full")
+
+type isuActivationJob struct {
+	jiaIsuUUID string
+	requestID  string
+	generation uint64
+}
+
+// activate待ちのISUをバックグラウンドでactivateする
+type ActivationWorker struct {
+	jobs chan isuActivationJob
+
+	mu         sync.RWMutex
+	generation uint64 // 初期化のたびに増える
+}
+
+func NewActivationWorker(capacity int) *ActivationWorker {
+	return &ActivationWorker{jobs: make(chan isuActivationJob, capacity)}
+}
+
+// ワーカーを起動する
+func (w *ActivationWorker) Run(workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range w.jobs {
+				w.activate(job)
+			}
+		}()
+	}
+}
+
+// ISUをactivate待ちのキューに積む
+func (w *ActivationWorker) Enqueue(jiaIsuUUID string, requestID string) error {
+	select {
+	case w.jobs <- isuActivationJob{jiaIsuUUID: jiaIsuUUID, requestID: requestID, generation: w.currentGeneration()}:
+		return nil
+	default:
+		return errActivationQueueFull
+	}
+}
+
+// 再起動などで中断したactivateをやり直す
+func (w *ActivationWorker) ResumePending() error {
+	jiaIsuUUIDList := []string{}
+	err := db.Select(&jiaIsuUUIDList, "SELECT `jia_isu_uuid` FROM `isu` WHERE `activation_status` = ?", isuActivationPending)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	generation := w.currentGeneration()
+	go func() {
+		for _, jiaIsuUUID := range jiaIsuUUIDList {
+			w.jobs <- isuActivationJob{jiaIsuUUID: jiaIsuUUID, generation: generation}
+		}
+	}()
+	return nil
+}
+
+// キューに積まれているISUを全て破棄する。
+// 処理中のISUは書き込みが終わるのを待ち、以降は書き込まずに打ち切らせる
+func (w *ActivationWorker) Reset() {
+	w.mu.Lock()
+	w.generation++
+	w.mu.Unlock()
+
+	for {
+		select {
+		case <-w.jobs:
+		default:
+			return
+		}
+	}
+}
+
+func (w *ActivationWorker) currentGeneration() uint64 {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.generation
+}
+
+// 初期化の前に積まれたジョブでなければfnを実行する。
+// 実行している間は初期化を待たせるので、初期化の後のテーブルには書き込まない
+func (w *ActivationWorker) runIfCurrent(job isuActivationJob, fn func() error) (bool, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if job.generation != w.generation {
+		return false, nil
+	}
+	return true, fn()
+}
+
+// 間隔を空けながらactivateを試み、最後まで失敗した場合はfailedにする
+func (w *ActivationWorker) activate(job isuActivationJob) {
+	var err error
+	for round := 1; round <= activationMaxRounds; round++ {
+		if w.currentGeneration() != job.generation {
+			return
+		}
+		err = w.activatePendingIsu(job)
+		if err == nil {
+			return
+		}
+		// JIAに断られた場合は、やり直しても結果は変わらない
+		var jiaErr *JIAServiceError
+		if errors.As(err, &jiaErr) && jiaErr.StatusCode < http.StatusInternalServerError {
+			break
+		}
+		if round < activationMaxRounds {
+			time.Sleep(activationRetryInterval << (round - 1))
+		}
+	}
+	log.Errorf("failed to activate isu: %v: %v", job.jiaIsuUUID, err)
+
+	current, dbErr := w.runIfCurrent(job, func() error {
+		_, err := db.Exec("UPDATE `isu` SET `activation_status` = ? WHERE `jia_isu_uuid` = ? AND `activation_status` = ?",
+			isuActivationFailed, job.jiaIsuUUID, isuActivationPending)
+		return err
+	})
+	if dbErr != nil {
+		log.Errorf("db error: %v", dbErr)
+	}
+	if !current {
+		return
+	}
+
+	var jiaErr *JIAServiceError
+	if !errors.As(err, &jiaErr) || jiaErr.StatusCode >= http.StatusInternalServerError {
+		// activateされたか分からないので、ISUがコンディションを送り続けないようdeactivateしておく
+		deactivateIsuQuietly(job.requestID, job.jiaIsuUUID)
+	}
+}
+
+// activate待ちのISUをactivateし、JIAから受け取った性格を保存する
+func (w *ActivationWorker) activatePendingIsu(job isuActivationJob) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(serverConfig.JIA.ActivateTimeout))
+	defer cancel()
+
+	isuFromJIA, err := jiaClient.Activate(ctx, getJIAServiceURL(db), job.requestID, job.jiaIsuUUID)
+	if err != nil {
+		return err
+	}
+
+	var affected int64
+	current, err := w.runIfCurrent(job, func() error {
+		result, err := db.Exec("UPDATE `isu` SET `character` = ?, `activation_status` = ?"+
+			"	WHERE `jia_isu_uuid` = ? AND `activation_status` = ?",
+			isuFromJIA.Character, isuActivationActive, job.jiaIsuUUID, isuActivationPending)
+		if err != nil {
+			return err
+		}
+		affected, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if !current || affected == 0 {
+		// activateしている間に登録が解除されたか、初期化された
+		deactivateIsuQuietly(job.requestID, job.jiaIsuUUID)
+	}
+	return nil
+}
+
+// POST /api/isu/:jia_isu_uuid/activate
+// activateに失敗したISUのactivateをやり直す
+func postIsuActivate(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+
+	_, errStatusCode, err = authorizeIsu(db, jiaUserID, jiaIsuUUID, isuRoleEditor)
+	if err != nil {
+		if errStatusCode == http.StatusNotFound {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, "forbidden")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	result, err := db.Exec("UPDATE `isu` SET `activation_status` = ? WHERE `jia_isu_uuid` = ? AND `activation_status` = ?",
+		isuActivationPending, jiaIsuUUID, isuActivationFailed)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if affected == 0 {
+		return c.String(http.StatusConflict, "not failed: isu")
+	}
+
+	err = activationWorker.Enqueue(jiaIsuUUID, getRequestID(c))
+	if err != nil {
+		_, dbErr := db.Exec("UPDATE `isu` SET `activation_status` = ? WHERE `jia_isu_uuid` = ? AND `activation_status` = ?",
+			isuActivationFailed, jiaIsuUUID, isuActivationPending)
+		if dbErr != nil {
+			c.Logger().Errorf("db error: %v", dbErr)
+		}
+		c.Logger().Error(err)
+		return c.String(http.StatusServiceUnavailable, "activation queue is full")
+	}
+
+	var isu Isu
+	err = db.Get(&isu, "SELECT * FROM `isu` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusAccepted, isu)
+}
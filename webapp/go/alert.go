@@ -0,0 +1,776 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	alertTypeConsecutiveLevel = "consecutive_level"
+	alertTypeCondition        = "condition"
+	alertTypeNoCondition      = "no_condition"
+
+	alertDeliveryStatusPending   = "pending"
+	alertDeliveryStatusDelivered = "delivered"
+	alertDeliveryStatusFailed    = "failed"
+
+	alertDeliveryQueueSize        = 1000
+	alertDeliveryWorkers          = 4
+	alertDeliveryMaxAttempts      = 5
+	alertDeliveryTimeout          = 5 * time.Second
+	alertDeliveryRetryInterval    = time.Second
+	alertDeliveryLogLimit         = 100
+	alertNoConditionCheckInterval = 30 * time.Second
+	alertMaxConsecutiveCount      = 100
+	alertEvaluationQueueCapacity  = 50000
+)
+
+var errWebhookAddressNotAllowed = errors.New("webhook address is not allowed")
+
+// webhookの送信先として許可しないアドレス。サーバーの内部のネットワークに送信させないようにする
+var nonPublicIPNets = mustParseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+type IsuAlertRule struct {
+	ID             int64     `db:"id" json:"id"`
+	JIAIsuUUID     string    `db:"jia_isu_uuid" json:"jia_isu_uuid"`
+	JIAUserID      string    `db:"jia_user_id" json:"-"`
+	Type           string    `db:"type" json:"type"`
+	ConditionLevel string    `db:"condition_level" json:"condition_level"`
+	ConditionName  string    `db:"condition_name" json:"condition_name"`
+	Threshold      int       `db:"threshold" json:"threshold"`
+	WebhookURL     string    `db:"webhook_url" json:"webhook_url"`
+	IsTriggered    bool      `db:"is_triggered" json:"is_triggered"`
+	CreatedAt      time.Time `db:"created_at" json:"-"`
+}
+
+type IsuAlertDelivery struct {
+	ID                 int64     `db:"id" json:"id"`
+	AlertRuleID        int64     `db:"alert_rule_id" json:"alert_rule_id"`
+	JIAIsuUUID         string    `db:"jia_isu_uuid" json:"jia_isu_uuid"`
+	WebhookURL         string    `db:"webhook_url" json:"webhook_url"`
+	Status             string    `db:"status" json:"status"`
+	Attempts           int       `db:"attempts" json:"attempts"`
+	ResponseStatusCode int       `db:"response_status_code" json:"response_status_code"`
+	ErrorMessage       string    `db:"error_message" json:"error_message"`
+	Payload            string    `db:"payload" json:"-"`
+	CreatedAt          time.Time `db:"created_at" json:"-"`
+	UpdatedAt          time.Time `db:"updated_at" json:"-"`
+}
+
+type GetIsuAlertDeliveryResponse struct {
+	IsuAlertDelivery
+	CreatedAt int64 `json:"created_at"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+type PostIsuAlertRuleRequest struct {
+	Type           string `json:"type"`
+	ConditionLevel string `json:"condition_level"`
+	ConditionName  string `json:"condition_name"`
+	Threshold      int    `json:"threshold"`
+	WebhookURL     string `json:"webhook_url"`
+}
+
+// webhookに送信する内容
+type AlertPayload struct {
+	AlertRuleID int64                    `json:"alert_rule_id"`
+	JIAIsuUUID  string                   `json:"jia_isu_uuid"`
+	Type        string                   `json:"type"`
+	TriggeredAt int64                    `json:"triggered_at"`
+	Condition   *GetIsuConditionResponse `json:"condition"`
+}
+
+// 書き込まれたコンディションに対してアラートルールを評価し、webhookへ通知する
+type AlertNotifier struct {
+	deliveries chan int64
+	client     *http.Client
+	notify     chan struct{}
+
+	mu             sync.Mutex
+	pending        []IsuCondition // 評価待ちのコンディション
+	lastReceivedAt map[string]time.Time
+	startedAt      time.Time
+}
+
+func NewAlertNotifier() *AlertNotifier {
+	return &AlertNotifier{
+		deliveries:     make(chan int64, alertDeliveryQueueSize),
+		client:         newAlertWebhookClient(),
+		notify:         make(chan struct{}, 1),
+		lastReceivedAt: map[string]time.Time{},
+		startedAt:      time.Now(),
+	}
+}
+
+// 評価と配信のワーカー、無通信の監視を開始する
+func (n *AlertNotifier) Run() {
+	for i := 0; i < alertDeliveryWorkers; i++ {
+		go n.deliverLoop()
+	}
+	go n.evaluateLoop()
+
+	pendingIDs := []int64{}
+	err := db.Select(&pendingIDs, "SELECT `id` FROM `isu_alert_delivery` WHERE `status` = ?", alertDeliveryStatusPending)
+	if err != nil {
+		log.Errorf("db error: %v", err)
+	}
+	for _, id := range pendingIDs {
+		n.enqueue(id)
+	}
+
+	ticker := time.NewTicker(alertNoConditionCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := n.checkNoCondition()
+		if err != nil {
+			log.Errorf("failed to check no condition alerts: %v", err)
+		}
+	}
+}
+
+// 受信状況をリセットする
+func (n *AlertNotifier) Reset() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.pending = nil
+	n.lastReceivedAt = map[string]time.Time{}
+	n.startedAt = time.Now()
+}
+
+// 書き込まれたコンディションを評価待ちに積む。
+// 評価はDBへの問い合わせを伴うので、コンディションの書き込みを待たせないよう別のgoroutineで行う
+func (n *AlertNotifier) Evaluate(conditions []IsuCondition) {
+	now := time.Now()
+	n.mu.Lock()
+	for _, condition := range conditions {
+		n.lastReceivedAt[condition.JIAIsuUUID] = now
+	}
+	if len(n.pending)+len(conditions) > alertEvaluationQueueCapacity {
+		n.mu.Unlock()
+		log.Warnf("alert evaluation queue is full: dropped %v conditions", len(conditions))
+		return
+	}
+	n.pending = append(n.pending, conditions...)
+	n.mu.Unlock()
+
+	select {
+	case n.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (n *AlertNotifier) evaluateLoop() {
+	for range n.notify {
+		n.mu.Lock()
+		conditions := n.pending
+		n.pending = nil
+		n.mu.Unlock()
+		if len(conditions) == 0 {
+			continue
+		}
+
+		err := n.evaluate(conditions)
+		if err != nil {
+			log.Errorf("failed to evaluate alert rules: %v", err)
+		}
+	}
+}
+
+// 書き込まれたコンディションを一件ずつ古い順に評価する。
+// 同じバッチ内で発火して解除された場合も通知する
+func (n *AlertNotifier) evaluate(conditions []IsuCondition) error {
+	conditionsByIsu := map[string][]IsuCondition{}
+	jiaIsuUUIDs := []string{}
+	for _, condition := range conditions {
+		if _, ok := conditionsByIsu[condition.JIAIsuUUID]; !ok {
+			jiaIsuUUIDs = append(jiaIsuUUIDs, condition.JIAIsuUUID)
+		}
+		conditionsByIsu[condition.JIAIsuUUID] = append(conditionsByIsu[condition.JIAIsuUUID], condition)
+	}
+
+	query, args, err := sqlx.In("SELECT * FROM `isu_alert_rule` WHERE `jia_isu_uuid` IN (?) ORDER BY `id`", jiaIsuUUIDs)
+	if err != nil {
+		return err
+	}
+	rules := []IsuAlertRule{}
+	err = db.Select(&rules, query, args...)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	rulesByIsu := map[string][]IsuAlertRule{}
+	for _, rule := range rules {
+		rulesByIsu[rule.JIAIsuUUID] = append(rulesByIsu[rule.JIAIsuUUID], rule)
+	}
+
+	for jiaIsuUUID, isuRules := range rulesByIsu {
+		isuConditions := conditionsByIsu[jiaIsuUUID]
+		sort.Slice(isuConditions, func(i, j int) bool { return isuConditions[i].Timestamp.Before(isuConditions[j].Timestamp) })
+
+		// 連続回数の判定に使う履歴は、ルールごとではなくISUごとに一度だけ取得する
+		maxThreshold := 0
+		for _, rule := range isuRules {
+			if rule.Type == alertTypeConsecutiveLevel && rule.Threshold > maxThreshold {
+				maxThreshold = rule.Threshold
+			}
+		}
+		var history []IsuCondition
+		if maxThreshold > 0 {
+			history, err = getRecentConditionLevels(jiaIsuUUID, isuConditions[len(isuConditions)-1].Timestamp, maxThreshold+len(isuConditions))
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, rule := range isuRules {
+			if rule.Type == alertTypeNoCondition {
+				// コンディションが届いたので解除する
+				err = n.updateTrigger(rule, false, nil, time.Now())
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			for i := range isuConditions {
+				condition := &isuConditions[i]
+				var matched bool
+				if rule.Type == alertTypeConsecutiveLevel {
+					matched = matchConsecutiveLevel(history, condition.Timestamp, rule)
+				} else {
+					matched = hasCondition(*condition, rule.ConditionName)
+				}
+
+				err = n.updateTrigger(rule, matched, condition, time.Now())
+				if err != nil {
+					return err
+				}
+				rule.IsTriggered = matched
+			}
+		}
+	}
+	return nil
+}
+
+// 一定時間コンディションが届いていないISUのアラートルールを評価する
+func (n *AlertNotifier) checkNoCondition() error {
+	rules := []IsuAlertRule{}
+	err := db.Select(&rules, "SELECT * FROM `isu_alert_rule` WHERE `type` = ? AND `is_triggered` = 0", alertTypeNoCondition)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	now := time.Now()
+	for _, rule := range rules {
+		n.mu.Lock()
+		lastReceivedAt, ok := n.lastReceivedAt[rule.JIAIsuUUID]
+		if !ok {
+			lastReceivedAt = n.startedAt
+		}
+		n.mu.Unlock()
+		if lastReceivedAt.Before(rule.CreatedAt) {
+			lastReceivedAt = rule.CreatedAt
+		}
+
+		if now.Sub(lastReceivedAt) < time.Duration(rule.Threshold)*time.Minute {
+			continue
+		}
+		err = n.updateTrigger(rule, true, nil, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ルールの発火状態を更新し、新たに発火した場合は通知を作成する
+func (n *AlertNotifier) updateTrigger(rule IsuAlertRule, matched bool, condition *IsuCondition, now time.Time) error {
+	if !matched {
+		if rule.IsTriggered {
+			_, err := db.Exec("UPDATE `isu_alert_rule` SET `is_triggered` = 0 WHERE `id` = ?", rule.ID)
+			if err != nil {
+				return fmt.Errorf("db error: %v", err)
+			}
+		}
+		return nil
+	}
+
+	result, err := db.Exec("UPDATE `isu_alert_rule` SET `is_triggered` = 1 WHERE `id` = ? AND `is_triggered` = 0", rule.ID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if affected == 0 {
+		return nil
+	}
+
+	payload := AlertPayload{
+		AlertRuleID: rule.ID,
+		JIAIsuUUID:  rule.JIAIsuUUID,
+		Type:        rule.Type,
+		TriggeredAt: now.Unix(),
+	}
+	if condition != nil {
+		payload.Condition = &GetIsuConditionResponse{
+			JIAIsuUUID:     condition.JIAIsuUUID,
+			Timestamp:      condition.Timestamp.Unix(),
+			IsSitting:      condition.IsSitting,
+			Condition:      condition.Condition,
+			ConditionLevel: condition.ConditionLevel,
+			Message:        condition.Message,
+		}
+	}
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	result, err = db.Exec(
+		"INSERT INTO `isu_alert_delivery`"+
+			"	(`alert_rule_id`, `jia_isu_uuid`, `webhook_url`, `status`, `payload`) VALUES (?, ?, ?, ?, ?)",
+		rule.ID, rule.JIAIsuUUID, rule.WebhookURL, alertDeliveryStatusPending, string(payloadJSON))
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	deliveryID, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	n.enqueue(deliveryID)
+	return nil
+}
+
+func (n *AlertNotifier) enqueue(deliveryID int64) {
+	select {
+	case n.deliveries <- deliveryID:
+	default:
+		// キューが溢れた場合はpendingのまま残し、少し待ってから積み直す
+		time.AfterFunc(alertDeliveryRetryInterval, func() { n.enqueue(deliveryID) })
+	}
+}
+
+func (n *AlertNotifier) deliverLoop() {
+	for deliveryID := range n.deliveries {
+		err := n.deliver(deliveryID)
+		if err != nil {
+			log.Errorf("failed to deliver alert: %v", err)
+		}
+	}
+}
+
+// webhookへ一度送信を試み、失敗した場合は回数に応じて間隔を空けて再送する
+func (n *AlertNotifier) deliver(deliveryID int64) error {
+	var delivery IsuAlertDelivery
+	err := db.Get(&delivery, "SELECT * FROM `isu_alert_delivery` WHERE `id` = ?", deliveryID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("db error: %v", err)
+	}
+	if delivery.Status != alertDeliveryStatusPending {
+		return nil
+	}
+
+	delivery.Attempts++
+	statusCode, err := postAlertWebhook(n.client, delivery.WebhookURL, delivery.Payload)
+	delivery.ResponseStatusCode = statusCode
+	delivery.ErrorMessage = ""
+	switch {
+	case err != nil:
+		delivery.ErrorMessage = err.Error()
+	case statusCode < 200 || 300 <= statusCode:
+		delivery.ErrorMessage = fmt.Sprintf("unexpected status code: %d", statusCode)
+	default:
+		delivery.Status = alertDeliveryStatusDelivered
+	}
+	if delivery.Status == alertDeliveryStatusPending && delivery.Attempts >= alertDeliveryMaxAttempts {
+		delivery.Status = alertDeliveryStatusFailed
+	}
+	if len(delivery.ErrorMessage) > 255 {
+		delivery.ErrorMessage = delivery.ErrorMessage[:255]
+	}
+
+	_, err = db.Exec(
+		"UPDATE `isu_alert_delivery` SET `status` = ?, `attempts` = ?, `response_status_code` = ?, `error_message` = ? WHERE `id` = ?",
+		delivery.Status, delivery.Attempts, delivery.ResponseStatusCode, delivery.ErrorMessage, delivery.ID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	if delivery.Status == alertDeliveryStatusPending {
+		backoff := alertDeliveryRetryInterval * time.Duration(1<<uint(delivery.Attempts-1))
+		time.AfterFunc(backoff, func() { n.enqueue(delivery.ID) })
+	}
+	return nil
+}
+
+// 接続先のアドレスを名前解決の後に確認するHTTPクライアント。
+// リダイレクト先や、作成時と異なるアドレスに解決される名前にも送信しない
+func newAlertWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: alertDeliveryTimeout,
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !isPublicIP(ip) {
+				return errWebhookAddressNotAllowed
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: alertDeliveryTimeout,
+		// プロキシを経由すると接続先を確認できないので、環境変数のプロキシは使わない
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: alertDeliveryTimeout,
+		},
+	}
+}
+
+func isPublicIP(ip net.IP) bool {
+	for _, ipNet := range nonPublicIPNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	ipNets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets
+}
+
+func postAlertWebhook(client *http.Client, webhookURL string, payload string) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, webhookURL, bytes.NewBufferString(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = ioutil.ReadAll(res.Body)
+
+	return res.StatusCode, nil
+}
+
+// 指定した時刻以前のコンディションのレベルを、新しい方から指定した件数だけ古い順で取得
+func getRecentConditionLevels(jiaIsuUUID string, until time.Time, limit int) ([]IsuCondition, error) {
+	history := []IsuCondition{}
+	err := db.Select(&history,
+		"SELECT `timestamp`, `condition_level` FROM `isu_condition` WHERE `jia_isu_uuid` = ? AND `timestamp` <= ?"+
+			"	ORDER BY `timestamp` DESC LIMIT ?",
+		jiaIsuUUID, until, limit)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+		history[i], history[j] = history[j], history[i]
+	}
+	return history, nil
+}
+
+// 指定した時刻のコンディションまでが、指定した回数連続で指定したレベルか判定
+func matchConsecutiveLevel(history []IsuCondition, timestamp time.Time, rule IsuAlertRule) bool {
+	idx := sort.Search(len(history), func(i int) bool { return !history[i].Timestamp.Before(timestamp) })
+	if idx == len(history) || !history[idx].Timestamp.Equal(timestamp) || idx+1 < rule.Threshold {
+		return false
+	}
+
+	for _, condition := range history[idx+1-rule.Threshold : idx+1] {
+		if condition.ConditionLevel != rule.ConditionLevel {
+			return false
+		}
+	}
+	return true
+}
+
+// コンディションの指定した項目がtrueになっているか判定
+func hasCondition(condition IsuCondition, conditionName string) bool {
+	switch conditionName {
+	case "is_dirty":
+		return condition.IsDirty
+	case "is_overweight":
+		return condition.IsOverweight
+	case "is_broken":
+		return condition.IsBroken
+	}
+	return false
+}
+
+func validateAlertRule(req PostIsuAlertRuleRequest) error {
+	switch req.Type {
+	case alertTypeConsecutiveLevel:
+		switch req.ConditionLevel {
+		case conditionLevelInfo, conditionLevelWarning, conditionLevelCritical:
+		default:
+			return fmt.Errorf("bad format: condition_level")
+		}
+		if req.Threshold < 1 || alertMaxConsecutiveCount < req.Threshold {
+			return fmt.Errorf("bad format: threshold")
+		}
+	case alertTypeCondition:
+		switch req.ConditionName {
+		case "is_dirty", "is_overweight", "is_broken":
+		default:
+			return fmt.Errorf("bad format: condition_name")
+		}
+	case alertTypeNoCondition:
+		if req.Threshold < 1 {
+			return fmt.Errorf("bad format: threshold")
+		}
+	default:
+		return fmt.Errorf("bad format: type")
+	}
+
+	u, err := url.Parse(req.WebhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || len(req.WebhookURL) > 255 {
+		return fmt.Errorf("bad format: webhook_url")
+	}
+	// 名前で指定された場合は送信時に解決したアドレスで確認する
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("bad format: webhook_url")
+	}
+	if ip := net.ParseIP(host); ip != nil && !isPublicIP(ip) {
+		return fmt.Errorf("bad format: webhook_url")
+	}
+	return nil
+}
+
+// GET /api/isu/:jia_isu_uuid/alert
+// ISUのアラートルールの一覧を取得
+func getIsuAlertRules(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	_, errStatusCode, err = authorizeIsu(db, jiaUserID, jiaIsuUUID, isuRoleViewer)
+	if err != nil {
+		if errStatusCode == http.StatusNotFound {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, "forbidden")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	rules := []IsuAlertRule{}
+	err = db.Select(&rules, "SELECT * FROM `isu_alert_rule` WHERE `jia_isu_uuid` = ? ORDER BY `id` ASC", jiaIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, rules)
+}
+
+// POST /api/isu/:jia_isu_uuid/alert
+// ISUのアラートルールを登録
+func postIsuAlertRule(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+
+	var req PostIsuAlertRuleRequest
+	err = c.Bind(&req)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	err = validateAlertRule(req)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	_, errStatusCode, err = authorizeIsu(db, jiaUserID, jiaIsuUUID, isuRoleEditor)
+	if err != nil {
+		if errStatusCode == http.StatusNotFound {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, "forbidden")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	result, err := db.Exec(
+		"INSERT INTO `isu_alert_rule`"+
+			"	(`jia_isu_uuid`, `jia_user_id`, `type`, `condition_level`, `condition_name`, `threshold`, `webhook_url`)"+
+			"	VALUES (?, ?, ?, ?, ?, ?, ?)",
+		jiaIsuUUID, jiaUserID, req.Type, req.ConditionLevel, req.ConditionName, req.Threshold, req.WebhookURL)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	ruleID, err := result.LastInsertId()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var rule IsuAlertRule
+	err = db.Get(&rule, "SELECT * FROM `isu_alert_rule` WHERE `id` = ?", ruleID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusCreated, rule)
+}
+
+// DELETE /api/isu/:jia_isu_uuid/alert/:alert_id
+// ISUのアラートルールを削除
+func deleteIsuAlertRule(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	alertID, err := strconv.ParseInt(c.Param("alert_id"), 10, 64)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad format: alert_id")
+	}
+
+	_, errStatusCode, err = authorizeIsu(db, jiaUserID, jiaIsuUUID, isuRoleEditor)
+	if err != nil {
+		if errStatusCode == http.StatusNotFound {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, "forbidden")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	result, err := db.Exec("DELETE FROM `isu_alert_rule` WHERE `id` = ? AND `jia_isu_uuid` = ?", alertID, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if affected == 0 {
+		return c.String(http.StatusNotFound, "not found: alert")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GET /api/isu/:jia_isu_uuid/alert/delivery
+// ISUのアラート通知の配信履歴を取得
+func getIsuAlertDeliveries(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	_, errStatusCode, err = authorizeIsu(db, jiaUserID, jiaIsuUUID, isuRoleViewer)
+	if err != nil {
+		if errStatusCode == http.StatusNotFound {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, "forbidden")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	deliveries := []IsuAlertDelivery{}
+	err = db.Select(&deliveries,
+		"SELECT * FROM `isu_alert_delivery` WHERE `jia_isu_uuid` = ? ORDER BY `id` DESC LIMIT ?",
+		jiaIsuUUID, alertDeliveryLogLimit)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := []GetIsuAlertDeliveryResponse{}
+	for _, delivery := range deliveries {
+		res = append(res, GetIsuAlertDeliveryResponse{
+			IsuAlertDelivery: delivery,
+			CreatedAt:        delivery.CreatedAt.Unix(),
+			UpdatedAt:        delivery.UpdatedAt.Unix(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
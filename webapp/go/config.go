@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// 設定ファイルのパスを指定する環境変数。--configが指定された場合はそちらを使う
+const configPathEnv = "ISUCONDITION_CONFIG"
+
+// webappの設定。設定ファイルの値を環境変数で上書きできる
+type ServerConfig struct {
+	Port                          string             `yaml:"port"`
+	PostIsuConditionTargetBaseURL string             `yaml:"post_isucondition_target_base_url"`
+	IsuActivationMode             string             `yaml:"isu_activation_mode"`
+	Paths                         PathConfig         `yaml:"paths"`
+	MySQL                         MySQLConnectionEnv `yaml:"mysql"`
+	Condition                     ConditionConfig    `yaml:"condition"`
+	Retention                     RetentionConfig    `yaml:"retention"`
+	Trend                         TrendConfig        `yaml:"trend"`
+	Session                       SessionConfig      `yaml:"session"`
+	JIA                           JIAConfig          `yaml:"jia"`
+}
+
+type PathConfig struct {
+	FrontendContents string `yaml:"frontend_contents"`
+	DefaultIconFile  string `yaml:"default_icon_file"`
+	IconDir          string `yaml:"icon_dir"`
+}
+
+type ConditionConfig struct {
+	Limit         int            `yaml:"limit"` // 件数を指定されなかった場合に返すコンディションの数
+	QueueCapacity int            `yaml:"queue_capacity"`
+	BatchSize     int            `yaml:"batch_size"`
+	FlushInterval ConfigDuration `yaml:"flush_interval"`
+}
+
+// Ageが0の場合はコンディションをアーカイブしない
+type RetentionConfig struct {
+	Age        ConfigDuration `yaml:"age"`
+	Interval   ConfigDuration `yaml:"interval"`
+	ArchiveDir string         `yaml:"archive_dir"`
+}
+
+type TrendConfig struct {
+	CacheTTL ConfigDuration `yaml:"cache_ttl"`
+}
+
+type SessionConfig struct {
+	Key       string `yaml:"key"`
+	Backend   string `yaml:"backend"`
+	CacheSize int    `yaml:"cache_size"` // Backendがmemoryの場合に保持するセッションの数
+}
+
+type JIAConfig struct {
+	JWKSPath         string         `yaml:"jwks_path"`
+	JWTIssuer        string         `yaml:"jwt_issuer"`
+	JWTAudience      string         `yaml:"jwt_audience"`
+	JWTLeeway        ConfigDuration `yaml:"jwt_leeway"`
+	RequestTimeout   ConfigDuration `yaml:"request_timeout"`  // 一回のリクエストのタイムアウト
+	ActivateTimeout  ConfigDuration `yaml:"activate_timeout"` // 再試行を含めたactivateとdeactivateのタイムアウト
+	MaxAttempts      int            `yaml:"max_attempts"`
+	RetryBackoff     ConfigDuration `yaml:"retry_backoff"`
+	BreakerThreshold int            `yaml:"breaker_threshold"`
+	BreakerCooldown  ConfigDuration `yaml:"breaker_cooldown"`
+}
+
+// "100ms" のような文字列で読み書きする時間
+type ConfigDuration time.Duration
+
+func (d ConfigDuration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d *ConfigDuration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	err := unmarshal(&s)
+	if err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = ConfigDuration(duration)
+	return nil
+}
+
+func defaultServerConfig() ServerConfig {
+	return ServerConfig{
+		Port: "3000",
+		// ベンチマーカーは登録直後に性格が決まっていることを期待するので、syncを既定にする
+		IsuActivationMode: isuActivationModeSync,
+		Paths: PathConfig{
+			FrontendContents: "../public",
+			DefaultIconFile:  "../NoImage.jpg",
+			IconDir:          "../icons",
+		},
+		MySQL: MySQLConnectionEnv{
+			Host:         "127.0.0.1",
+			Port:         "3306",
+			User:         "isucon",
+			DBName:       "isucondition",
+			Password:     "isucon",
+			MaxOpenConns: 10,
+		},
+		Condition: ConditionConfig{
+			Limit:         20,
+			QueueCapacity: 50000,
+			BatchSize:     1000,
+			FlushInterval: ConfigDuration(100 * time.Millisecond),
+		},
+		Retention: RetentionConfig{
+			Interval:   ConfigDuration(defaultConditionRetentionInterval),
+			ArchiveDir: defaultConditionArchiveDir,
+		},
+		Trend: TrendConfig{
+			CacheTTL: ConfigDuration(defaultTrendCacheTTL),
+		},
+		Session: SessionConfig{
+			Key:       "isucondition",
+			Backend:   sessionBackendMySQL,
+			CacheSize: defaultSessionCacheSize,
+		},
+		JIA: JIAConfig{
+			JWKSPath:         defaultJIAJWKSPath,
+			JWTLeeway:        ConfigDuration(defaultJIAJWTLeeway),
+			RequestTimeout:   ConfigDuration(defaultJIARequestTimeout),
+			ActivateTimeout:  ConfigDuration(defaultJIAActivateTimeout),
+			MaxAttempts:      defaultJIAMaxAttempts,
+			RetryBackoff:     ConfigDuration(defaultJIARetryBackoff),
+			BreakerThreshold: defaultJIABreakerThreshold,
+			BreakerCooldown:  ConfigDuration(defaultJIABreakerCooldown),
+		},
+	}
+}
+
+// 既定値に設定ファイル、環境変数の順で値を重ね、検証した設定を返す。
+// pathが空の場合は設定ファイルを読まない
+func LoadServerConfig(path string) (ServerConfig, error) {
+	config, err := readServerConfig(path)
+	if err != nil {
+		return config, err
+	}
+
+	err = config.validate()
+	if err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// migrateコマンド用に設定を読む。使わない項目は検証しない
+func LoadMigrateConfig(path string) (ServerConfig, error) {
+	config, err := readServerConfig(path)
+	if err != nil {
+		return config, err
+	}
+
+	err = config.validateMySQL()
+	if err != nil {
+		return config, err
+	}
+	err = config.validatePaths()
+	if err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+func readServerConfig(path string) (ServerConfig, error) {
+	config := defaultServerConfig()
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return config, fmt.Errorf("failed to read config: %v", err)
+		}
+		// 書き間違えた項目が黙って無視されないよう、知らない項目はエラーにする
+		err = yaml.UnmarshalStrict(data, &config)
+		if err != nil {
+			return config, fmt.Errorf("failed to parse config: %v: %v", path, err)
+		}
+	}
+
+	err := config.applyEnv()
+	if err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// 環境変数が設定されていれば、その値で上書きする
+func (sc *ServerConfig) applyEnv() error {
+	overrideString(&sc.Port, "SERVER_APP_PORT")
+	overrideString(&sc.PostIsuConditionTargetBaseURL, "POST_ISUCONDITION_TARGET_BASE_URL")
+	overrideString(&sc.IsuActivationMode, "ISU_ACTIVATION_MODE")
+
+	overrideString(&sc.Paths.FrontendContents, "FRONTEND_CONTENTS_PATH")
+	overrideString(&sc.Paths.DefaultIconFile, "DEFAULT_ICON_FILE_PATH")
+	overrideString(&sc.Paths.IconDir, "ISU_ICON_DIR")
+
+	overrideString(&sc.MySQL.Host, "MYSQL_HOST")
+	overrideString(&sc.MySQL.Port, "MYSQL_PORT")
+	overrideString(&sc.MySQL.User, "MYSQL_USER")
+	overrideString(&sc.MySQL.DBName, "MYSQL_DBNAME")
+	overrideString(&sc.MySQL.Password, "MYSQL_PASS")
+
+	overrideString(&sc.Retention.ArchiveDir, "CONDITION_ARCHIVE_DIR")
+
+	overrideString(&sc.Session.Key, "SESSION_KEY")
+	overrideString(&sc.Session.Backend, "SESSION_BACKEND")
+
+	overrideString(&sc.JIA.JWKSPath, "JIA_JWKS_PATH")
+	overrideString(&sc.JIA.JWTIssuer, "JIA_JWT_ISSUER")
+	overrideString(&sc.JIA.JWTAudience, "JIA_JWT_AUDIENCE")
+
+	intOverrides := []struct {
+		dst *int
+		key string
+	}{
+		{&sc.MySQL.MaxOpenConns, "MYSQL_MAX_OPEN_CONNS"},
+		{&sc.Condition.Limit, "CONDITION_LIMIT"},
+		{&sc.Condition.QueueCapacity, "CONDITION_QUEUE_CAPACITY"},
+		{&sc.Condition.BatchSize, "CONDITION_BATCH_SIZE"},
+		{&sc.Session.CacheSize, "SESSION_CACHE_SIZE"},
+		{&sc.JIA.MaxAttempts, "JIA_MAX_ATTEMPTS"},
+		{&sc.JIA.BreakerThreshold, "JIA_BREAKER_THRESHOLD"},
+	}
+	for _, o := range intOverrides {
+		err := overrideInt(o.dst, o.key)
+		if err != nil {
+			return err
+		}
+	}
+
+	durationOverrides := []struct {
+		dst *ConfigDuration
+		key string
+	}{
+		{&sc.Condition.FlushInterval, "CONDITION_FLUSH_INTERVAL"},
+		{&sc.Retention.Age, "CONDITION_RETENTION"},
+		{&sc.Retention.Interval, "CONDITION_RETENTION_INTERVAL"},
+		{&sc.Trend.CacheTTL, "TREND_CACHE_TTL"},
+		{&sc.JIA.JWTLeeway, "JIA_JWT_LEEWAY"},
+		{&sc.JIA.RequestTimeout, "JIA_REQUEST_TIMEOUT"},
+		{&sc.JIA.ActivateTimeout, "JIA_ACTIVATE_TIMEOUT"},
+		{&sc.JIA.RetryBackoff, "JIA_RETRY_BACKOFF"},
+		{&sc.JIA.BreakerCooldown, "JIA_BREAKER_COOLDOWN"},
+	}
+	for _, o := range durationOverrides {
+		err := overrideDuration(o.dst, o.key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 文字列は空の値でも上書きできるよう、環境変数が設定されているかで判断する
+func overrideString(dst *string, key string) {
+	val, ok := os.LookupEnv(key)
+	if ok {
+		*dst = val
+	}
+}
+
+func overrideInt(dst *int, key string) error {
+	val := os.Getenv(key)
+	if val == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return fmt.Errorf("bad format: %v", key)
+	}
+	*dst = n
+	return nil
+}
+
+func overrideDuration(dst *ConfigDuration, key string) error {
+	val := os.Getenv(key)
+	if val == "" {
+		return nil
+	}
+	duration, err := time.ParseDuration(val)
+	if err != nil {
+		return fmt.Errorf("bad format: %v", key)
+	}
+	*dst = ConfigDuration(duration)
+	return nil
+}
+
+func (sc *ServerConfig) validate() error {
+	port, err := strconv.Atoi(sc.Port)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("invalid config: port: %v", sc.Port)
+	}
+	if sc.PostIsuConditionTargetBaseURL == "" {
+		return fmt.Errorf("missing: POST_ISUCONDITION_TARGET_BASE_URL")
+	}
+	u, err := url.Parse(sc.PostIsuConditionTargetBaseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid config: post_isucondition_target_base_url: %v", sc.PostIsuConditionTargetBaseURL)
+	}
+	if sc.IsuActivationMode != isuActivationModeSync && sc.IsuActivationMode != isuActivationModeAsync {
+		return fmt.Errorf("invalid config: isu_activation_mode: %v", sc.IsuActivationMode)
+	}
+
+	err = sc.validatePaths()
+	if err != nil {
+		return err
+	}
+	err = sc.validateMySQL()
+	if err != nil {
+		return err
+	}
+
+	if sc.Condition.Limit < 1 || sc.Condition.Limit > conditionMaxLimit {
+		return fmt.Errorf("invalid config: condition.limit must be between 1 and %v", conditionMaxLimit)
+	}
+	if sc.Condition.QueueCapacity < 1 || sc.Condition.BatchSize < 1 || sc.Condition.FlushInterval <= 0 {
+		return fmt.Errorf("invalid config: condition.queue_capacity, condition.batch_size and condition.flush_interval must be positive")
+	}
+	if sc.Retention.Age < 0 || sc.Retention.Interval <= 0 || sc.Retention.ArchiveDir == "" {
+		return fmt.Errorf("invalid config: retention.age must not be negative, and retention.interval and retention.archive_dir are required")
+	}
+	if sc.Trend.CacheTTL < 0 {
+		return fmt.Errorf("invalid config: trend.cache_ttl: %v", time.Duration(sc.Trend.CacheTTL))
+	}
+
+	if sc.Session.Key == "" {
+		return fmt.Errorf("invalid config: session.key is required")
+	}
+	if sc.Session.Backend != sessionBackendMySQL && sc.Session.Backend != sessionBackendMemory {
+		return fmt.Errorf("invalid config: session.backend: %v", sc.Session.Backend)
+	}
+	if sc.Session.CacheSize < 1 {
+		return fmt.Errorf("invalid config: session.cache_size: %v", sc.Session.CacheSize)
+	}
+
+	if sc.JIA.JWKSPath == "" {
+		return fmt.Errorf("invalid config: jia.jwks_path is required")
+	}
+	if sc.JIA.JWTLeeway < 0 {
+		return fmt.Errorf("invalid config: jia.jwt_leeway: %v", time.Duration(sc.JIA.JWTLeeway))
+	}
+	if sc.JIA.RequestTimeout <= 0 || sc.JIA.ActivateTimeout <= 0 || sc.JIA.RetryBackoff <= 0 || sc.JIA.BreakerCooldown <= 0 {
+		return fmt.Errorf("invalid config: jia.request_timeout, jia.activate_timeout, jia.retry_backoff and jia.breaker_cooldown must be positive")
+	}
+	if sc.JIA.MaxAttempts < 1 || sc.JIA.BreakerThreshold < 1 {
+		return fmt.Errorf("invalid config: jia.max_attempts and jia.breaker_threshold must be positive")
+	}
+	return nil
+}
+
+func (sc *ServerConfig) validatePaths() error {
+	if sc.Paths.FrontendContents == "" || sc.Paths.DefaultIconFile == "" || sc.Paths.IconDir == "" {
+		return fmt.Errorf("invalid config: paths must not be empty")
+	}
+	return nil
+}
+
+func (sc *ServerConfig) validateMySQL() error {
+	if sc.MySQL.Host == "" || sc.MySQL.Port == "" || sc.MySQL.User == "" || sc.MySQL.DBName == "" {
+		return fmt.Errorf("invalid config: mysql.host, mysql.port, mysql.user and mysql.dbname are required")
+	}
+	if sc.MySQL.MaxOpenConns < 1 {
+		return fmt.Errorf("invalid config: mysql.max_open_conns: %v", sc.MySQL.MaxOpenConns)
+	}
+	return nil
+}
+
+// 設定をYAMLで書き出す。パスワードとセッションの鍵は伏せる
+func (sc ServerConfig) String() string {
+	if sc.MySQL.Password != "" {
+		sc.MySQL.Password = "********"
+	}
+	if sc.Session.Key != "" {
+		sc.Session.Key = "********"
+	}
+	data, err := yaml.Marshal(sc)
+	if err != nil {
+		return fmt.Sprintf("failed to marshal config: %v", err)
+	}
+	return string(data)
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	exportFormatCSV    = "csv"
+	exportFormatNDJSON = "ndjson"
+	exportFlushRows    = 1000
+)
+
+var exportCSVHeader = []string{"jia_isu_uuid", "timestamp", "is_sitting", "condition", "condition_level", "message"}
+
+// エクスポートするコンディション
+type ExportIsuCondition struct {
+	JIAIsuUUID     string `json:"jia_isu_uuid"`
+	Timestamp      int64  `json:"timestamp"`
+	IsSitting      bool   `json:"is_sitting"`
+	Condition      string `json:"condition"`
+	ConditionLevel string `json:"condition_level"`
+	Message        string `json:"message"`
+}
+
+// GET /api/isu/:jia_isu_uuid/conditions/export
+// ISUのコンディションの履歴をCSVまたはNDJSONでダウンロード。
+// 保持期間を過ぎてアーカイブしたコンディションはアーカイブファイルから読み、DBのコンディションとタイムスタンプの順に混ぜる
+func getIsuConditionsExport(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+
+	format := c.QueryParam("format")
+	if format == "" {
+		format = exportFormatCSV
+	}
+	if format != exportFormatCSV && format != exportFormatNDJSON {
+		return c.String(http.StatusBadRequest, "bad format: format")
+	}
+
+	query := "SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ?"
+	args := []interface{}{jiaIsuUUID}
+	timeRange := exportTimeRange{start: math.MinInt64, end: math.MaxInt64}
+	startTimeStr := c.QueryParam("start_time")
+	if startTimeStr != "" {
+		startTimeInt64, err := strconv.ParseInt(startTimeStr, 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: start_time")
+		}
+		query += "	AND ? <= `timestamp`"
+		args = append(args, time.Unix(startTimeInt64, 0))
+		timeRange.start = startTimeInt64
+	}
+	endTimeStr := c.QueryParam("end_time")
+	if endTimeStr != "" {
+		endTimeInt64, err := strconv.ParseInt(endTimeStr, 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: end_time")
+		}
+		query += "	AND `timestamp` < ?"
+		args = append(args, time.Unix(endTimeInt64, 0))
+		timeRange.end = endTimeInt64
+	}
+	query += "	ORDER BY `timestamp`, `id`"
+
+	_, errStatusCode, err = authorizeIsu(db, jiaUserID, jiaIsuUUID, isuRoleViewer)
+	if err != nil {
+		if errStatusCode == http.StatusNotFound {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, "forbidden")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	archives, err := listIsuConditionArchives(serverConfig.Retention.ArchiveDir, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// 全ての行をメモリに載せないよう、一行ずつ読みながら書き出す
+	rows, err := db.Queryx(query, args...)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer rows.Close()
+	nextRow := func() (ArchivedIsuCondition, bool, error) {
+		if !rows.Next() {
+			if err := rows.Err(); err != nil {
+				return ArchivedIsuCondition{}, false, fmt.Errorf("db error: %v", err)
+			}
+			return ArchivedIsuCondition{}, false, nil
+		}
+		var condition IsuCondition
+		err := rows.StructScan(&condition)
+		if err != nil {
+			return ArchivedIsuCondition{}, false, fmt.Errorf("db error: %v", err)
+		}
+		return ArchivedIsuCondition{
+			ID:             condition.ID,
+			JIAIsuUUID:     condition.JIAIsuUUID,
+			Timestamp:      condition.Timestamp.Unix(),
+			IsSitting:      condition.IsSitting,
+			Condition:      condition.Condition,
+			ConditionLevel: condition.ConditionLevel,
+			Message:        condition.Message,
+		}, true, nil
+	}
+	merged := newExportConditionMerger(nextRow, archives, openIsuConditionArchive, timeRange)
+	defer merged.Close()
+
+	res := c.Response()
+	if format == exportFormatCSV {
+		res.Header().Set(echo.HeaderContentType, "text/csv; charset=UTF-8")
+	} else {
+		res.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	}
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"%s.%s\"", jiaIsuUUID, format))
+	res.WriteHeader(http.StatusOK)
+
+	// ヘッダを送った後はステータスコードを変えられないので、エラーはログに残して打ち切る
+	err = writeIsuConditionsExport(res, merged.Next, format)
+	if err != nil {
+		c.Logger().Errorf("failed to export isu conditions: %v", err)
+	}
+	return nil
+}
+
+func writeIsuConditionsExport(res *echo.Response, next func() (ArchivedIsuCondition, bool, error), format string) error {
+	csvWriter := csv.NewWriter(res)
+	jsonEncoder := json.NewEncoder(res)
+	flush := func() error {
+		if format == exportFormatCSV {
+			csvWriter.Flush()
+			if err := csvWriter.Error(); err != nil {
+				return err
+			}
+		}
+		res.Flush()
+		return nil
+	}
+
+	if format == exportFormatCSV {
+		err := csvWriter.Write(exportCSVHeader)
+		if err != nil {
+			return err
+		}
+	}
+
+	count := 0
+	for {
+		condition, ok, err := next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+
+		row := ExportIsuCondition{
+			JIAIsuUUID:     condition.JIAIsuUUID,
+			Timestamp:      condition.Timestamp,
+			IsSitting:      condition.IsSitting,
+			Condition:      condition.Condition,
+			ConditionLevel: condition.ConditionLevel,
+			Message:        condition.Message,
+		}
+		if format == exportFormatCSV {
+			err = csvWriter.Write([]string{
+				row.JIAIsuUUID,
+				strconv.FormatInt(row.Timestamp, 10),
+				strconv.FormatBool(row.IsSitting),
+				row.Condition,
+				row.ConditionLevel,
+				row.Message,
+			})
+		} else {
+			err = jsonEncoder.Encode(row)
+		}
+		if err != nil {
+			return err
+		}
+
+		count++
+		if count%exportFlushRows == 0 {
+			err = flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// エクスポートするタイムスタンプの範囲。startを含みendを含まない
+type exportTimeRange struct {
+	start int64
+	end   int64
+}
+
+// タイムスタンプとIDの順に並んだコンディションの読み出し元
+type exportConditionSource struct {
+	current ArchivedIsuCondition
+	next    func() (ArchivedIsuCondition, bool, error)
+	close   func() error
+}
+
+type exportConditionHeap []*exportConditionSource
+
+func (h exportConditionHeap) Len() int { return len(h) }
+func (h exportConditionHeap) Less(i, j int) bool {
+	return exportConditionLess(h[i].current, h[j].current)
+}
+func (h exportConditionHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *exportConditionHeap) Push(x interface{}) { *h = append(*h, x.(*exportConditionSource)) }
+func (h *exportConditionHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func exportConditionLess(a ArchivedIsuCondition, b ArchivedIsuCondition) bool {
+	if a.Timestamp != b.Timestamp {
+		return a.Timestamp < b.Timestamp
+	}
+	return a.ID < b.ID
+}
+
+// DBのコンディションとアーカイブファイルのコンディションを、タイムスタンプとIDの順に混ぜて読み出す。
+// アーカイブファイルは最初のコンディションの順に並べておき、そのタイムスタンプまで読み進めてから開くので、
+// 同時に開くのは期間が重なるファイルだけになる
+type exportConditionMerger struct {
+	heap     exportConditionHeap
+	archives []isuConditionArchive
+	open     func(isuConditionArchive) (func() (ArchivedIsuCondition, bool, error), func() error, error)
+	rng      exportTimeRange
+	last     *ArchivedIsuCondition
+	err      error
+}
+
+func newExportConditionMerger(nextRow func() (ArchivedIsuCondition, bool, error), archives []isuConditionArchive,
+	open func(isuConditionArchive) (func() (ArchivedIsuCondition, bool, error), func() error, error), rng exportTimeRange) *exportConditionMerger {
+
+	m := &exportConditionMerger{archives: archives, open: open, rng: rng}
+	m.err = m.push(&exportConditionSource{next: nextRow})
+	return m
+}
+
+// 範囲内の次のコンディションまで読み進めてから積む。読み終えた読み出し元は閉じる
+func (m *exportConditionMerger) push(source *exportConditionSource) error {
+	for {
+		condition, ok, err := source.next()
+		if err != nil {
+			return err
+		}
+		// ファイル内は順に並んでいるので、範囲を過ぎたら残りは読まない
+		if !ok || condition.Timestamp >= m.rng.end {
+			if source.close != nil {
+				return source.close()
+			}
+			return nil
+		}
+		if condition.Timestamp < m.rng.start {
+			continue
+		}
+		source.current = condition
+		heap.Push(&m.heap, source)
+		return nil
+	}
+}
+
+// 次のコンディションを読み出す。アーカイブした後に削除できなかったコンディションは二度読み出さない
+func (m *exportConditionMerger) Next() (ArchivedIsuCondition, bool, error) {
+	for m.err == nil {
+		for len(m.archives) > 0 && m.archives[0].firstTimestamp < m.rng.end &&
+			(m.heap.Len() == 0 || m.archives[0].firstTimestamp <= m.heap[0].current.Timestamp) {
+			archive := m.archives[0]
+			m.archives = m.archives[1:]
+			next, closeFunc, err := m.open(archive)
+			if err != nil {
+				m.err = err
+				break
+			}
+			m.err = m.push(&exportConditionSource{next: next, close: closeFunc})
+			if m.err != nil {
+				break
+			}
+		}
+		if m.err != nil || m.heap.Len() == 0 {
+			break
+		}
+
+		source := heap.Pop(&m.heap).(*exportConditionSource)
+		condition := source.current
+		m.err = m.push(source)
+		if m.last != nil && m.last.ID == condition.ID && m.last.Timestamp == condition.Timestamp {
+			continue
+		}
+		m.last = &condition
+		return condition, true, nil
+	}
+	return ArchivedIsuCondition{}, false, m.err
+}
+
+// 開いているアーカイブファイルを閉じる
+func (m *exportConditionMerger) Close() {
+	for _, source := range m.heap {
+		if source.close != nil {
+			source.close()
+		}
+	}
+	m.heap = nil
+}
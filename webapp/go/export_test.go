@@ -0,0 +1,154 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func sliceSource(conditions []ArchivedIsuCondition) func() (ArchivedIsuCondition, bool, error) {
+	return func() (ArchivedIsuCondition, bool, error) {
+		if len(conditions) == 0 {
+			return ArchivedIsuCondition{}, false, nil
+		}
+		condition := conditions[0]
+		conditions = conditions[1:]
+		return condition, true, nil
+	}
+}
+
+func TestExportConditionMerger(t *testing.T) {
+	c := func(timestamp int64, id int) ArchivedIsuCondition {
+		return ArchivedIsuCondition{ID: id, JIAIsuUUID: "a", Timestamp: timestamp}
+	}
+	all := exportTimeRange{start: math.MinInt64, end: math.MaxInt64}
+
+	tests := []struct {
+		name     string
+		rows     []ArchivedIsuCondition
+		archives [][]ArchivedIsuCondition
+		rng      exportTimeRange
+		want     []ArchivedIsuCondition
+	}{
+		{
+			name: "db only",
+			rows: []ArchivedIsuCondition{c(10, 1), c(20, 2)},
+			rng:  all,
+			want: []ArchivedIsuCondition{c(10, 1), c(20, 2)},
+		},
+		{
+			name:     "archives before db",
+			rows:     []ArchivedIsuCondition{c(30, 5)},
+			archives: [][]ArchivedIsuCondition{{c(10, 1), c(20, 2)}},
+			rng:      all,
+			want:     []ArchivedIsuCondition{c(10, 1), c(20, 2), c(30, 5)},
+		},
+		{
+			// 遅れて届いたコンディションは、アーカイブした期間より前でもDBに残っている
+			name:     "late condition interleaves with archives",
+			rows:     []ArchivedIsuCondition{c(15, 9), c(40, 10)},
+			archives: [][]ArchivedIsuCondition{{c(10, 1), c(20, 2)}, {c(12, 3), c(30, 4)}},
+			rng:      all,
+			want:     []ArchivedIsuCondition{c(10, 1), c(12, 3), c(15, 9), c(20, 2), c(30, 4), c(40, 10)},
+		},
+		{
+			// アーカイブを書き出した後に削除できなかったコンディションは、ファイルとDBの両方にある
+			name:     "archived but not deleted",
+			rows:     []ArchivedIsuCondition{c(20, 2), c(30, 3)},
+			archives: [][]ArchivedIsuCondition{{c(10, 1), c(20, 2)}, {c(10, 1), c(20, 2)}},
+			rng:      all,
+			want:     []ArchivedIsuCondition{c(10, 1), c(20, 2), c(30, 3)},
+		},
+		{
+			name:     "range",
+			rows:     []ArchivedIsuCondition{c(30, 3)},
+			archives: [][]ArchivedIsuCondition{{c(10, 1), c(20, 2)}, {c(40, 4)}},
+			rng:      exportTimeRange{start: 20, end: 40},
+			want:     []ArchivedIsuCondition{c(20, 2), c(30, 3)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archives := []isuConditionArchive{}
+			byPath := map[string][]ArchivedIsuCondition{}
+			for i, conditions := range tt.archives {
+				path := string(rune('a' + i))
+				byPath[path] = conditions
+				archives = append(archives, isuConditionArchive{path: path, firstTimestamp: conditions[0].Timestamp})
+			}
+			opened := 0
+			closed := 0
+			open := func(archive isuConditionArchive) (func() (ArchivedIsuCondition, bool, error), func() error, error) {
+				opened++
+				return sliceSource(byPath[archive.path]), func() error { closed++; return nil }, nil
+			}
+
+			m := newExportConditionMerger(sliceSource(tt.rows), archives, open, tt.rng)
+			got := []ArchivedIsuCondition{}
+			for {
+				condition, ok, err := m.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ok {
+					break
+				}
+				got = append(got, condition)
+			}
+			m.Close()
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if opened != closed {
+				t.Errorf("opened %d archives but closed %d", opened, closed)
+			}
+		})
+	}
+}
+
+func TestIsuConditionArchiveRoundTrip(t *testing.T) {
+	r := &ConditionRetention{dir: t.TempDir()}
+	base := time.Date(2021, 8, 1, 10, 0, 0, 0, time.Local)
+	conditions := []IsuCondition{
+		{ID: 1, JIAIsuUUID: "a", Timestamp: base, Condition: "is_dirty=true,is_overweight=false,is_broken=false", ConditionLevel: conditionLevelWarning, Message: "1"},
+		{ID: 2, JIAIsuUUID: "a", Timestamp: base.Add(time.Minute), IsSitting: true, ConditionLevel: conditionLevelInfo, Message: "2"},
+	}
+	err := r.writeArchive("a", conditions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archives, err := listIsuConditionArchives(r.dir, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archives) != 1 || archives[0].firstTimestamp != base.Unix() {
+		t.Fatalf("got archives %v", archives)
+	}
+
+	next, closeFunc, err := openIsuConditionArchive(archives[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+	for _, want := range conditions {
+		got, ok, err := next()
+		if err != nil || !ok {
+			t.Fatalf("next() = %v, %v", ok, err)
+		}
+		if got.ID != want.ID || got.Timestamp != want.Timestamp.Unix() || got.IsSitting != want.IsSitting ||
+			got.Condition != want.Condition || got.ConditionLevel != want.ConditionLevel || got.Message != want.Message {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+	if _, ok, err := next(); ok || err != nil {
+		t.Errorf("expected the end of the archive, got %v, %v", ok, err)
+	}
+
+	missing, err := listIsuConditionArchives(r.dir, "b")
+	if err != nil || len(missing) != 0 {
+		t.Errorf("listIsuConditionArchives for an isu without archives = %v, %v", missing, err)
+	}
+}
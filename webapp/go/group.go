@@ -0,0 +1,576 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const isuGroupNameMaxLength = 255
+
+// ユーザーが自分のISUをまとめるグループ
+type IsuGroup struct {
+	ID        int64     `db:"id"`
+	JIAUserID string    `db:"jia_user_id"`
+	Name      string    `db:"name"`
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+type IsuGroupMember struct {
+	GroupID    int64  `db:"group_id"`
+	JIAIsuUUID string `db:"jia_isu_uuid"`
+}
+
+type GetIsuGroupResponse struct {
+	ID          int64    `json:"id"`
+	Name        string   `json:"name"`
+	JIAIsuUUIDs []string `json:"jia_isu_uuids"`
+}
+
+type PostIsuGroupRequest struct {
+	Name        string   `json:"name"`
+	JIAIsuUUIDs []string `json:"jia_isu_uuids"`
+}
+
+type PatchIsuGroupRequest struct {
+	Name string `json:"name"`
+}
+
+type PostIsuGroupMemberRequest struct {
+	JIAIsuUUID string `json:"jia_isu_uuid"`
+}
+
+type GetIsuGroupSummaryResponse struct {
+	ID              int64                `json:"id"`
+	Name            string               `json:"name"`
+	IsuCount        int                  `json:"isu_count"`
+	ConditionLevels GroupConditionLevels `json:"condition_levels"`
+	Graph           []GroupGraphResponse `json:"graph"`
+}
+
+// グループのISUの最新のコンディションレベルごとの台数
+type GroupConditionLevels struct {
+	Info        int `json:"info"`
+	Warning     int `json:"warning"`
+	Critical    int `json:"critical"`
+	NoCondition int `json:"no_condition"`
+}
+
+// グループのISUのグラフのデータ点を平均したもの
+type GroupGraphResponse struct {
+	StartAt  int64           `json:"start_at"`
+	EndAt    int64           `json:"end_at"`
+	Data     *GraphDataPoint `json:"data"`
+	IsuCount int             `json:"isu_count"` // データのあるISUの数
+}
+
+func validateIsuGroupName(name string) error {
+	if name == "" {
+		return fmt.Errorf("missing: name")
+	}
+	if len(name) > isuGroupNameMaxLength {
+		return fmt.Errorf("bad format: name")
+	}
+	return nil
+}
+
+// 自分のグループを取得
+func findIsuGroup(jiaUserID string, groupIDStr string) (IsuGroup, error) {
+	var group IsuGroup
+	groupID, err := strconv.ParseInt(groupIDStr, 10, 64)
+	if err != nil {
+		return group, sql.ErrNoRows
+	}
+	err = db.Get(&group, "SELECT * FROM `isu_group` WHERE `id` = ? AND `jia_user_id` = ?", groupID, jiaUserID)
+	return group, err
+}
+
+func getIsuGroupMemberUUIDs(groupID int64) ([]string, error) {
+	jiaIsuUUIDs := []string{}
+	err := db.Select(&jiaIsuUUIDs,
+		"SELECT `jia_isu_uuid` FROM `isu_group_member` WHERE `group_id` = ? ORDER BY `created_at`, `jia_isu_uuid`",
+		groupID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return jiaIsuUUIDs, nil
+}
+
+// GET /api/group
+// 自分のグループの一覧を取得
+func getIsuGroupList(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	groupList := []IsuGroup{}
+	err = db.Select(&groupList, "SELECT * FROM `isu_group` WHERE `jia_user_id` = ? ORDER BY `id` DESC", jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	members := []IsuGroupMember{}
+	err = db.Select(&members,
+		"SELECT `m`.`group_id`, `m`.`jia_isu_uuid` FROM `isu_group_member` AS `m`"+
+			"	JOIN `isu_group` AS `g` ON `m`.`group_id` = `g`.`id`"+
+			"	WHERE `g`.`jia_user_id` = ? ORDER BY `m`.`created_at`, `m`.`jia_isu_uuid`",
+		jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	memberUUIDs := map[int64][]string{}
+	for _, member := range members {
+		memberUUIDs[member.GroupID] = append(memberUUIDs[member.GroupID], member.JIAIsuUUID)
+	}
+
+	responseList := []GetIsuGroupResponse{}
+	for _, group := range groupList {
+		jiaIsuUUIDs, ok := memberUUIDs[group.ID]
+		if !ok {
+			jiaIsuUUIDs = []string{}
+		}
+		responseList = append(responseList, GetIsuGroupResponse{ID: group.ID, Name: group.Name, JIAIsuUUIDs: jiaIsuUUIDs})
+	}
+
+	return c.JSON(http.StatusOK, responseList)
+}
+
+// POST /api/group
+// グループを作成
+func postIsuGroup(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var req PostIsuGroupRequest
+	err = c.Bind(&req)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	err = validateIsuGroupName(req.Name)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	canAccess, err := canAccessIsus(jiaUserID, req.JIAIsuUUIDs)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !canAccess {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO `isu_group` (`jia_user_id`, `name`) VALUES (?, ?)", jiaUserID, req.Name)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	groupID, err := result.LastInsertId()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	for _, jiaIsuUUID := range req.JIAIsuUUIDs {
+		_, err = tx.Exec("INSERT IGNORE INTO `isu_group_member` (`group_id`, `jia_isu_uuid`) VALUES (?, ?)", groupID, jiaIsuUUID)
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUIDs, err := getIsuGroupMemberUUIDs(groupID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusCreated, GetIsuGroupResponse{ID: groupID, Name: req.Name, JIAIsuUUIDs: jiaIsuUUIDs})
+}
+
+// GET /api/group/:group_id
+// グループの情報を取得
+func getIsuGroupID(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	group, err := findIsuGroup(jiaUserID, c.Param("group_id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: group")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUIDs, err := getIsuGroupMemberUUIDs(group.ID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, GetIsuGroupResponse{ID: group.ID, Name: group.Name, JIAIsuUUIDs: jiaIsuUUIDs})
+}
+
+// PATCH /api/group/:group_id
+// グループの名前を変更
+func patchIsuGroup(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var req PatchIsuGroupRequest
+	err = c.Bind(&req)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	err = validateIsuGroupName(req.Name)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	group, err := findIsuGroup(jiaUserID, c.Param("group_id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: group")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	_, err = db.Exec("UPDATE `isu_group` SET `name` = ? WHERE `id` = ?", req.Name, group.ID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUIDs, err := getIsuGroupMemberUUIDs(group.ID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, GetIsuGroupResponse{ID: group.ID, Name: req.Name, JIAIsuUUIDs: jiaIsuUUIDs})
+}
+
+// DELETE /api/group/:group_id
+// グループを削除。グループのISUは削除しない
+func deleteIsuGroup(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	group, err := findIsuGroup(jiaUserID, c.Param("group_id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: group")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM `isu_group_member` WHERE `group_id` = ?", group.ID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	_, err = tx.Exec("DELETE FROM `isu_group` WHERE `id` = ?", group.ID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// POST /api/group/:group_id/isu
+// グループにISUを追加
+func postIsuGroupMember(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var req PostIsuGroupMemberRequest
+	err = c.Bind(&req)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	if req.JIAIsuUUID == "" {
+		return c.String(http.StatusBadRequest, "missing: jia_isu_uuid")
+	}
+
+	group, err := findIsuGroup(jiaUserID, c.Param("group_id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: group")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	_, errStatusCode, err = authorizeIsu(db, jiaUserID, req.JIAIsuUUID, isuRoleViewer)
+	if err != nil {
+		if errStatusCode == http.StatusNotFound {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	_, err = db.Exec("INSERT IGNORE INTO `isu_group_member` (`group_id`, `jia_isu_uuid`) VALUES (?, ?)", group.ID, req.JIAIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUIDs, err := getIsuGroupMemberUUIDs(group.ID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, GetIsuGroupResponse{ID: group.ID, Name: group.Name, JIAIsuUUIDs: jiaIsuUUIDs})
+}
+
+// DELETE /api/group/:group_id/isu/:jia_isu_uuid
+// グループからISUを外す
+func deleteIsuGroupMember(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	group, err := findIsuGroup(jiaUserID, c.Param("group_id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: group")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	result, err := db.Exec("DELETE FROM `isu_group_member` WHERE `group_id` = ? AND `jia_isu_uuid` = ?",
+		group.ID, c.Param("jia_isu_uuid"))
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if affected == 0 {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GET /api/group/:group_id/summary
+// グループのISUの最新のコンディションレベルの内訳と、datetimeから24時間分の時間ごとの平均のグラフを取得
+func getIsuGroupSummary(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	datetimeStr := c.QueryParam("datetime")
+	if datetimeStr == "" {
+		return c.String(http.StatusBadRequest, "missing: datetime")
+	}
+	datetimeInt64, err := strconv.ParseInt(datetimeStr, 10, 64)
+	if err != nil || datetimeInt64 < conditionMinTimestamp || conditionMaxTimestamp < datetimeInt64 {
+		return c.String(http.StatusBadRequest, "bad format: datetime")
+	}
+	startTime := time.Unix(datetimeInt64, 0).Truncate(time.Hour)
+	endTime := startTime.Add(24 * time.Hour)
+
+	group, err := findIsuGroup(jiaUserID, c.Param("group_id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: group")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUIDs, err := getIsuGroupMemberUUIDs(group.ID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := GetIsuGroupSummaryResponse{
+		ID:       group.ID,
+		Name:     group.Name,
+		IsuCount: len(jiaIsuUUIDs),
+	}
+	for _, jiaIsuUUID := range jiaIsuUUIDs {
+		latest, ok := latestConditionStore.Get(jiaIsuUUID)
+		if !ok {
+			res.ConditionLevels.NoCondition++
+			continue
+		}
+		switch latest.ConditionLevel {
+		case conditionLevelInfo:
+			res.ConditionLevels.Info++
+		case conditionLevelWarning:
+			res.ConditionLevels.Warning++
+		case conditionLevelCritical:
+			res.ConditionLevels.Critical++
+		}
+	}
+
+	res.Graph, err = generateIsuGroupGraph(jiaIsuUUIDs, startTime, endTime)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// ISUごとのグラフのデータ点を時間ごとに平均する
+func generateIsuGroupGraph(jiaIsuUUIDs []string, startTime time.Time, endTime time.Time) ([]GroupGraphResponse, error) {
+	hourlyList := []IsuConditionHourly{}
+	if len(jiaIsuUUIDs) > 0 {
+		query, args, err := sqlx.In(
+			"SELECT * FROM `isu_condition_hourly` WHERE `jia_isu_uuid` IN (?)"+
+				"	AND ? <= `start_at` AND `start_at` < ?",
+			jiaIsuUUIDs, startTime, endTime)
+		if err != nil {
+			return nil, err
+		}
+		err = db.Select(&hourlyList, query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("db error: %v", err)
+		}
+	}
+
+	sums := make([]GraphDataPoint, endTime.Sub(startTime)/time.Hour)
+	counts := make([]int, len(sums))
+	for _, hourly := range hourlyList {
+		i := hourly.StartAt.Sub(startTime) / time.Hour
+		point := hourly.graphDataPoint()
+		sums[i].Score += point.Score
+		sums[i].Percentage.Sitting += point.Percentage.Sitting
+		sums[i].Percentage.IsBroken += point.Percentage.IsBroken
+		sums[i].Percentage.IsDirty += point.Percentage.IsDirty
+		sums[i].Percentage.IsOverweight += point.Percentage.IsOverweight
+		counts[i]++
+	}
+
+	responseList := []GroupGraphResponse{}
+	for i := range sums {
+		thisTime := startTime.Add(time.Duration(i) * time.Hour)
+		resp := GroupGraphResponse{
+			StartAt:  thisTime.Unix(),
+			EndAt:    thisTime.Add(time.Hour).Unix(),
+			IsuCount: counts[i],
+		}
+		if counts[i] > 0 {
+			resp.Data = &GraphDataPoint{
+				Score: sums[i].Score / counts[i],
+				Percentage: ConditionsPercentage{
+					Sitting:      sums[i].Percentage.Sitting / counts[i],
+					IsBroken:     sums[i].Percentage.IsBroken / counts[i],
+					IsDirty:      sums[i].Percentage.IsDirty / counts[i],
+					IsOverweight: sums[i].Percentage.IsOverweight / counts[i],
+				},
+			}
+		}
+		responseList = append(responseList, resp)
+	}
+	return responseList, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const healthCheckTimeout = 2 * time.Second
+
+var healthCheckClient = &http.Client{Timeout: healthCheckTimeout}
+
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// GET /healthz
+// MySQLに接続できるか確認する
+func getHealthz(c echo.Context) error {
+	return respondHealth(c, map[string]func(context.Context) error{
+		"mysql": checkMySQL,
+	})
+}
+
+// GET /readyz
+// MySQLと、設定されたJIAのサービスに接続できるか確認する
+func getReadyz(c echo.Context) error {
+	return respondHealth(c, map[string]func(context.Context) error{
+		"mysql": checkMySQL,
+		"jia":   checkJIAService,
+	})
+}
+
+// 全ての確認が成功すれば200、一つでも失敗すれば503を返す
+func respondHealth(c echo.Context, checks map[string]func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), healthCheckTimeout)
+	defer cancel()
+
+	res := HealthResponse{Status: "ok", Checks: map[string]string{}}
+	for name, check := range checks {
+		err := check(ctx)
+		if err != nil {
+			c.Logger().Warnf("health check failed: %v: %v", name, err)
+			res.Status = "unavailable"
+			res.Checks[name] = err.Error()
+			continue
+		}
+		res.Checks[name] = "ok"
+	}
+
+	c.Response().Header().Set("Cache-Control", "no-store")
+	if res.Status != "ok" {
+		return c.JSON(http.StatusServiceUnavailable, res)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func checkMySQL(ctx context.Context) error {
+	err := db.PingContext(ctx)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// JIAのサービスがHTTPで応答するか確認する。5xx以外の応答であれば接続できているとみなす
+func checkJIAService(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, getJIAServiceURL(db), nil)
+	if err != nil {
+		return err
+	}
+	res, err := healthCheckClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to request to JIAService: %v", err)
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("JIAService returned error: status code %v", res.StatusCode)
+	}
+	return nil
+}
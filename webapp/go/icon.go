@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const iconMigrationBatchSize = 100
+
+var iconHashRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ISUのアイコンを内容のハッシュをキーとしてファイルに保存する
+type IconStore struct {
+	dir string
+}
+
+func NewIconStore(dir string) (*IconStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create icon dir: %v", err)
+	}
+	return &IconStore{dir: dir}, nil
+}
+
+func (s *IconStore) path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+// アイコンを保存し、そのハッシュを返す。同じ内容のアイコンは一つのファイルを共有する
+func (s *IconStore) Put(image []byte) (string, error) {
+	sum := sha256.Sum256(image)
+	hash := hex.EncodeToString(sum[:])
+
+	path := s.path(hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", fmt.Errorf("failed to create icon dir: %v", err)
+	}
+	// 書き込み途中のファイルを読まれないよう、一時ファイルに書いてから置き換える
+	tmp, err := ioutil.TempFile(filepath.Dir(path), hash+".tmp")
+	if err != nil {
+		return "", fmt.Errorf("failed to write icon: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(image)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to write icon: %v", err)
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return "", fmt.Errorf("failed to write icon: %v", err)
+	}
+	return hash, nil
+}
+
+// ハッシュに対応するアイコンを取得
+func (s *IconStore) Get(hash string) ([]byte, error) {
+	if !iconHashRegexp.MatchString(hash) {
+		return nil, fmt.Errorf("bad format: icon hash: %v", hash)
+	}
+	image, err := ioutil.ReadFile(s.path(hash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read icon: %v", err)
+	}
+	return image, nil
+}
+
+// If-None-Matchヘッダが指定したETagに一致するか
+func matchETag(ifNoneMatch string, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// isuテーブルのimageカラムのアイコンをアイコンストアに移し、ハッシュのみを残す
+func moveIsuImagesToIconStore(db *sqlx.DB) error {
+	type isuImage struct {
+		ID    int    `db:"id"`
+		Image []byte `db:"image"`
+	}
+
+	for {
+		images := []isuImage{}
+		err := db.Select(&images,
+			"SELECT `id`, `image` FROM `isu` WHERE `image_hash` = '' ORDER BY `id` LIMIT ?",
+			iconMigrationBatchSize)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		if len(images) == 0 {
+			return nil
+		}
+
+		for _, image := range images {
+			hash, err := iconStore.Put(image.Image)
+			if err != nil {
+				return err
+			}
+			_, err = db.Exec("UPDATE `isu` SET `image_hash` = ?, `updated_at` = `updated_at` WHERE `id` = ?",
+				hash, image.ID)
+			if err != nil {
+				return fmt.Errorf("db error: %v", err)
+			}
+		}
+	}
+}
+
+// アイコンストアのアイコンをisuテーブルのimageカラムに書き戻す
+func restoreIsuImagesFromIconStore(db *sqlx.DB) error {
+	isuList := []Isu{}
+	err := db.Select(&isuList, "SELECT `id`, `image_hash` FROM `isu` WHERE `image_hash` != ''")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	for _, isu := range isuList {
+		image, err := iconStore.Get(isu.ImageHash)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec("UPDATE `isu` SET `image` = ?, `updated_at` = `updated_at` WHERE `id` = ?",
+			image, isu.ID)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+	return nil
+}
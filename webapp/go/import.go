@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	importMaxRows       = 100000
+	importMaxLineLength = 1024 * 1024
+)
+
+var errImportTooManyRows = errors.New("too many rows")
+
+// インポートできなかった行
+type ImportIsuConditionError struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+type ImportIsuConditionsResponse struct {
+	Imported   int                       `json:"imported"`
+	Duplicated int                       `json:"duplicated"`
+	Errors     []ImportIsuConditionError `json:"errors"`
+}
+
+// インポートする一行
+type importIsuConditionRow struct {
+	line int
+	req  PostIsuConditionRequest
+}
+
+// POST /api/isu/:jia_isu_uuid/conditions/import
+// ISUのコンディションの履歴をCSVまたはNDJSONから取り込む。
+// 不正な行と既に存在するタイムスタンプの行は取り込まずに、行番号とともに返す
+func postIsuConditionsImport(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+
+	format := c.QueryParam("format")
+	if format == "" {
+		format = exportFormatNDJSON
+		if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), "text/csv") {
+			format = exportFormatCSV
+		}
+	}
+	if format != exportFormatCSV && format != exportFormatNDJSON {
+		return c.String(http.StatusBadRequest, "bad format: format")
+	}
+
+	_, errStatusCode, err = authorizeIsu(db, jiaUserID, jiaIsuUUID, isuRoleEditor)
+	if err != nil {
+		if errStatusCode == http.StatusNotFound {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, "forbidden")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := ImportIsuConditionsResponse{Errors: []ImportIsuConditionError{}}
+	var rows []importIsuConditionRow
+	if format == exportFormatCSV {
+		rows, res.Errors, err = readImportCSV(c.Request().Body)
+	} else {
+		rows, res.Errors, err = readImportNDJSON(c.Request().Body)
+	}
+	if err != nil {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("bad request body: %v", err))
+	}
+
+	conditions := []IsuCondition{}
+	lines := []int{}
+	for _, row := range rows {
+		condition, err := newIsuCondition(jiaIsuUUID, row.req)
+		if err != nil {
+			res.Errors = append(res.Errors, ImportIsuConditionError{Line: row.line, Message: err.Error()})
+			continue
+		}
+		conditions = append(conditions, condition)
+		lines = append(lines, row.line)
+	}
+
+	existing, err := getIsuConditionTimestamps(jiaIsuUUID, conditions)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	newConditions := []IsuCondition{}
+	newLines := []int{}
+	for i, condition := range conditions {
+		timestamp := condition.Timestamp.Unix()
+		if _, ok := existing[timestamp]; ok {
+			res.Duplicated++
+			res.Errors = append(res.Errors, ImportIsuConditionError{Line: lines[i], Message: "duplicated: timestamp"})
+			continue
+		}
+		existing[timestamp] = struct{}{}
+		newConditions = append(newConditions, condition)
+		newLines = append(newLines, lines[i])
+	}
+
+	// 過去のコンディションなので、購読者への配信とアラートの評価は行わない
+	for len(newConditions) > 0 {
+		n := len(newConditions)
+		if n > serverConfig.Condition.BatchSize {
+			n = serverConfig.Condition.BatchSize
+		}
+		batch := newConditions[:n]
+
+		inserted, err := insertIsuConditions(batch)
+		if err != nil {
+			// 書き込めたバッチは取り消せないので、書き込めなかった行を報告して打ち切る
+			c.Logger().Error(err)
+			for _, line := range newLines {
+				res.Errors = append(res.Errors, ImportIsuConditionError{Line: line, Message: "failed to insert"})
+			}
+			break
+		}
+		latestConditionStore.Update(inserted)
+
+		// 確認の後に同じタイムスタンプのコンディションが届いていた場合は、それを正とする
+		res.Imported += len(inserted)
+		res.Duplicated += n - len(inserted)
+		newConditions = newConditions[n:]
+		newLines = newLines[n:]
+	}
+
+	sort.SliceStable(res.Errors, func(i, j int) bool { return res.Errors[i].Line < res.Errors[j].Line })
+	return c.JSON(http.StatusOK, res)
+}
+
+// 時間ごとの集計から、ISUの既存のコンディションのタイムスタンプを取得する。
+// 集計にはアーカイブしたコンディションのタイムスタンプも含まれる
+func getIsuConditionTimestamps(jiaIsuUUID string, conditions []IsuCondition) (map[int64]struct{}, error) {
+	timestamps := map[int64]struct{}{}
+	if len(conditions) == 0 {
+		return timestamps, nil
+	}
+
+	minTimestamp, maxTimestamp := conditions[0].Timestamp, conditions[0].Timestamp
+	for _, condition := range conditions {
+		if condition.Timestamp.Before(minTimestamp) {
+			minTimestamp = condition.Timestamp
+		}
+		if condition.Timestamp.After(maxTimestamp) {
+			maxTimestamp = condition.Timestamp
+		}
+	}
+
+	hourlyList := []IsuConditionHourly{}
+	err := db.Select(&hourlyList,
+		"SELECT * FROM `isu_condition_hourly` WHERE `jia_isu_uuid` = ? AND ? <= `start_at` AND `start_at` <= ?",
+		jiaIsuUUID, minTimestamp.Truncate(time.Hour), maxTimestamp.Truncate(time.Hour))
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	for _, hourly := range hourlyList {
+		hourlyTimestamps, err := hourly.conditionTimestamps()
+		if err != nil {
+			return nil, err
+		}
+		for _, timestamp := range hourlyTimestamps {
+			timestamps[timestamp] = struct{}{}
+		}
+	}
+	return timestamps, nil
+}
+
+// 一行に一つのPostIsuConditionRequestを読み込む
+func readImportNDJSON(r io.Reader) ([]importIsuConditionRow, []ImportIsuConditionError, error) {
+	rows := []importIsuConditionRow{}
+	errs := []ImportIsuConditionError{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), importMaxLineLength)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if len(rows) >= importMaxRows {
+			return nil, nil, errImportTooManyRows
+		}
+
+		var req PostIsuConditionRequest
+		err := json.Unmarshal([]byte(text), &req)
+		if err != nil {
+			errs = append(errs, ImportIsuConditionError{Line: line, Message: "bad format: json"})
+			continue
+		}
+		rows = append(rows, importIsuConditionRow{line: line, req: req})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return rows, errs, nil
+}
+
+// ヘッダ行の列名でPostIsuConditionRequestの各項目を読み込む。
+// エクスポートしたCSVをそのまま読み込めるよう、余分な列は無視する
+func readImportCSV(r io.Reader) ([]importIsuConditionRow, []ImportIsuConditionError, error) {
+	rows := []importIsuConditionRow{}
+	errs := []ImportIsuConditionError{}
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("missing: header")
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{"is_sitting", "condition", "timestamp"} {
+		if _, ok := columns[name]; !ok {
+			return nil, nil, fmt.Errorf("missing column: %v", name)
+		}
+	}
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return record[i]
+	}
+
+	// 行番号はヘッダを1行目として数える。値に改行を含む行があるとずれる
+	line := 1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				errs = append(errs, ImportIsuConditionError{Line: line, Message: "bad format: csv"})
+				continue
+			}
+			return nil, nil, err
+		}
+		if len(rows) >= importMaxRows {
+			return nil, nil, errImportTooManyRows
+		}
+
+		isSitting, err := strconv.ParseBool(field(record, "is_sitting"))
+		if err != nil {
+			errs = append(errs, ImportIsuConditionError{Line: line, Message: "bad format: is_sitting"})
+			continue
+		}
+		timestamp, err := strconv.ParseInt(field(record, "timestamp"), 10, 64)
+		if err != nil {
+			errs = append(errs, ImportIsuConditionError{Line: line, Message: "bad format: timestamp"})
+			continue
+		}
+		rows = append(rows, importIsuConditionRow{
+			line: line,
+			req: PostIsuConditionRequest{
+				IsSitting: isSitting,
+				Condition: field(record, "condition"),
+				Message:   field(record, "message"),
+				Timestamp: timestamp,
+			},
+		})
+	}
+	return rows, errs, nil
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/gommon/log"
+)
+
+var (
+	errConditionQueueFull = errors.New("condition queue is full")
+
+	conditionInsertMu sync.Mutex
+)
+
+// ISUから受け取ったコンディションをキューに溜め、まとめてDBに書き込む
+type ConditionIngester struct {
+	mu        sync.Mutex
+	queue     []IsuCondition
+	capacity  int
+	batchSize int
+	interval  time.Duration
+	notify    chan struct{}
+
+	// 書き込み中のバッチとResetを排他する
+	flushMu sync.Mutex
+}
+
+func NewConditionIngester(capacity int, batchSize int, interval time.Duration) *ConditionIngester {
+	return &ConditionIngester{
+		queue:     make([]IsuCondition, 0, batchSize),
+		capacity:  capacity,
+		batchSize: batchSize,
+		interval:  interval,
+		notify:    make(chan struct{}, 1),
+	}
+}
+
+// コンディションをキューに積む。キューに入り切らない場合は一件も積まずにエラーを返す
+func (ci *ConditionIngester) Enqueue(conditions []IsuCondition) error {
+	ci.mu.Lock()
+	if len(ci.queue)+len(conditions) > ci.capacity {
+		ci.mu.Unlock()
+		return errConditionQueueFull
+	}
+	ci.queue = append(ci.queue, conditions...)
+	shouldFlush := len(ci.queue) >= ci.batchSize
+	ci.mu.Unlock()
+
+	if shouldFlush {
+		select {
+		case ci.notify <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// キューに溜まっているコンディションの数
+func (ci *ConditionIngester) Len() int {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	return len(ci.queue)
+}
+
+// キューに溜まったコンディションを定期的にDBへ書き込み続ける
+func (ci *ConditionIngester) Run() {
+	ticker := time.NewTicker(ci.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ci.notify:
+		}
+		ci.flush()
+	}
+}
+
+// キューに積まれているコンディションを全て破棄する
+func (ci *ConditionIngester) Reset() {
+	ci.flushMu.Lock()
+	defer ci.flushMu.Unlock()
+
+	ci.mu.Lock()
+	ci.queue = make([]IsuCondition, 0, ci.batchSize)
+	ci.mu.Unlock()
+}
+
+// 指定したISUのまだ書き込まれていないコンディションを破棄する
+func (ci *ConditionIngester) Discard(jiaIsuUUID string) {
+	ci.flushMu.Lock()
+	defer ci.flushMu.Unlock()
+
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	queue := make([]IsuCondition, 0, len(ci.queue))
+	for _, condition := range ci.queue {
+		if condition.JIAIsuUUID != jiaIsuUUID {
+			queue = append(queue, condition)
+		}
+	}
+	ci.queue = queue
+}
+
+// キューが空になるまでバッチ単位で書き込む。
+// DBに接続できずに書き込めなかったコンディションはキューに残し、次回のflushで再送する
+func (ci *ConditionIngester) flush() {
+	ci.flushMu.Lock()
+	defer ci.flushMu.Unlock()
+
+	for {
+		batch := ci.peek()
+		if len(batch) == 0 {
+			return
+		}
+
+		// 途中で失敗しても、それまでに書き込んだ分は反映してキューから取り除く
+		inserted, processed, err := insertIsuConditionsOrDrop(batch)
+		if len(inserted) > 0 {
+			latestConditionStore.Update(inserted)
+			conditionHub.Publish(inserted)
+			alertNotifier.Evaluate(inserted)
+		}
+
+		ci.mu.Lock()
+		ci.queue = ci.queue[processed:]
+		ci.mu.Unlock()
+
+		if err != nil {
+			log.Errorf("failed to insert isu conditions: %v", err)
+			return
+		}
+	}
+}
+
+// コンディションをまとめて書き込む。DBには接続できるのに書き込めない場合は、
+// バッチを分割して書き込めない行だけを捨て、一つの不正な行がキューの先頭で詰まり続けないようにする。
+// 書き込んだコンディションと、先頭から何件の書き込みか破棄を終えたかを返す
+func insertIsuConditionsOrDrop(conditions []IsuCondition) ([]IsuCondition, int, error) {
+	return splitInsertIsuConditions(conditions, insertIsuConditions, func() error { return db.Ping() })
+}
+
+func splitInsertIsuConditions(conditions []IsuCondition, insert func([]IsuCondition) ([]IsuCondition, error), ping func() error) ([]IsuCondition, int, error) {
+	inserted, err := insert(conditions)
+	if err == nil {
+		return inserted, len(conditions), nil
+	}
+	pingErr := ping()
+	if pingErr != nil {
+		return []IsuCondition{}, 0, fmt.Errorf("%v (db is unreachable: %v)", err, pingErr)
+	}
+
+	if len(conditions) == 1 {
+		condition := conditions[0]
+		log.Errorf("dropped isu condition that cannot be inserted: jia_isu_uuid=%v timestamp=%v condition=%q message=%q: %v",
+			condition.JIAIsuUUID, condition.Timestamp.Unix(), condition.Condition, condition.Message, err)
+		conditionsDropped.Inc()
+		return []IsuCondition{}, 1, nil
+	}
+
+	half := len(conditions) / 2
+	first, processed, err := splitInsertIsuConditions(conditions[:half], insert, ping)
+	if err != nil {
+		return first, processed, err
+	}
+	second, processed, err := splitInsertIsuConditions(conditions[half:], insert, ping)
+	return append(first, second...), half + processed, err
+}
+
+func (ci *ConditionIngester) peek() []IsuCondition {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	n := len(ci.queue)
+	if n > ci.batchSize {
+		n = ci.batchSize
+	}
+	batch := make([]IsuCondition, n)
+	copy(batch, ci.queue[:n])
+	return batch
+}
+
+// コンディションをまとめてINSERTし、実際に書き込んだコンディションを返す。
+// 同じISUの同じタイムスタンプのコンディションは最初に書き込んだものを正とし、
+// 後から届いたものは内容が異なっていても捨てる(JIAやISUの再送を想定)
+func insertIsuConditions(conditions []IsuCondition) ([]IsuCondition, error) {
+	// 既存のタイムスタンプの確認から書き込みまでの間に、他の書き込みが割り込まないようにする
+	conditionInsertMu.Lock()
+	defer conditionInsertMu.Unlock()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	conditions, err = excludeDeletedIsuConditions(tx, conditions)
+	if err != nil {
+		return nil, err
+	}
+	if len(conditions) == 0 {
+		return conditions, nil
+	}
+
+	received := len(conditions)
+	conditions, err = excludeDuplicatedIsuConditions(tx, conditions)
+	if err != nil {
+		return nil, err
+	}
+	if len(conditions) == 0 {
+		conditionsDuplicated.Add(float64(received))
+		return conditions, nil
+	}
+
+	// 重複は除いてあるので、書き込めない値はIGNOREで警告にせずエラーにする
+	_, err = tx.NamedExec(
+		"INSERT INTO `isu_condition`"+
+			"	(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `is_dirty`, `is_overweight`, `is_broken`, `condition_level`, `message`)"+
+			"	VALUES (:jia_isu_uuid, :timestamp, :is_sitting, :condition, :is_dirty, :is_overweight, :is_broken, :condition_level, :message)",
+		conditions)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	err = addIsuConditionsHourly(tx, conditions)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	conditionsInserted.Add(float64(len(conditions)))
+	conditionsDuplicated.Add(float64(received - len(conditions)))
+	return conditions, nil
+}
+
+// 登録が解除されたISUのコンディションを除く。
+// 書き込みが終わるまで登録解除を待たせるため、ISUを共有ロックする
+func excludeDeletedIsuConditions(tx *sqlx.Tx, conditions []IsuCondition) ([]IsuCondition, error) {
+	jiaIsuUUIDs := []string{}
+	seen := map[string]struct{}{}
+	for _, condition := range conditions {
+		if _, ok := seen[condition.JIAIsuUUID]; !ok {
+			seen[condition.JIAIsuUUID] = struct{}{}
+			jiaIsuUUIDs = append(jiaIsuUUIDs, condition.JIAIsuUUID)
+		}
+	}
+
+	query, args, err := sqlx.In("SELECT `jia_isu_uuid` FROM `isu` WHERE `jia_isu_uuid` IN (?) LOCK IN SHARE MODE", jiaIsuUUIDs)
+	if err != nil {
+		return nil, err
+	}
+	existing := []string{}
+	err = tx.Select(&existing, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	registered := map[string]struct{}{}
+	for _, jiaIsuUUID := range existing {
+		registered[jiaIsuUUID] = struct{}{}
+	}
+
+	kept := make([]IsuCondition, 0, len(conditions))
+	for _, condition := range conditions {
+		if _, ok := registered[condition.JIAIsuUUID]; ok {
+			kept = append(kept, condition)
+		}
+	}
+	if len(kept) < len(conditions) {
+		conditionsRejected.Add(float64(len(conditions)-len(kept)), "not_found")
+	}
+	return kept, nil
+}
+
+// 同じISUの同じタイムスタンプのコンディションを見分けるキー
+type isuConditionKey struct {
+	jiaIsuUUID string
+	timestamp  int64
+}
+
+// 同じISUの同じタイムスタンプのコンディションのうち、既に書き込まれているものとバッチ内で二度目以降のものを除く。
+// アーカイブして削除した時間のコンディションは、時間ごとの集計に残したタイムスタンプで確認する
+func excludeDuplicatedIsuConditions(tx *sqlx.Tx, conditions []IsuCondition) ([]IsuCondition, error) {
+	placeholders := make([]string, 0, len(conditions))
+	args := make([]interface{}, 0, len(conditions)*2)
+	for _, condition := range conditions {
+		placeholders = append(placeholders, "(?, ?)")
+		args = append(args, condition.JIAIsuUUID, condition.Timestamp)
+	}
+	existing := []IsuCondition{}
+	err := tx.Select(&existing,
+		"SELECT `jia_isu_uuid`, `timestamp` FROM `isu_condition`"+
+			"	WHERE (`jia_isu_uuid`, `timestamp`) IN ("+strings.Join(placeholders, ", ")+")",
+		args...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	hourlyPlaceholders := []string{}
+	hourlyArgs := []interface{}{}
+	hours := map[isuConditionKey]struct{}{}
+	for _, condition := range conditions {
+		startAt := condition.Timestamp.Truncate(time.Hour)
+		key := isuConditionKey{condition.JIAIsuUUID, startAt.Unix()}
+		if _, ok := hours[key]; ok {
+			continue
+		}
+		hours[key] = struct{}{}
+		hourlyPlaceholders = append(hourlyPlaceholders, "(?, ?)")
+		hourlyArgs = append(hourlyArgs, condition.JIAIsuUUID, startAt)
+	}
+	archivedList := []IsuConditionHourly{}
+	err = tx.Select(&archivedList,
+		"SELECT * FROM `isu_condition_hourly` WHERE `archived` = 1"+
+			"	AND (`jia_isu_uuid`, `start_at`) IN ("+strings.Join(hourlyPlaceholders, ", ")+")",
+		hourlyArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	seen := map[isuConditionKey]struct{}{}
+	for _, condition := range existing {
+		seen[isuConditionKey{condition.JIAIsuUUID, condition.Timestamp.Unix()}] = struct{}{}
+	}
+	err = addHourlyConditionKeys(seen, archivedList)
+	if err != nil {
+		return nil, err
+	}
+	return filterDuplicatedIsuConditions(conditions, seen), nil
+}
+
+// 時間ごとの集計に含まれるコンディションのキーを加える
+func addHourlyConditionKeys(seen map[isuConditionKey]struct{}, hourlyList []IsuConditionHourly) error {
+	for _, hourly := range hourlyList {
+		timestamps, err := hourly.conditionTimestamps()
+		if err != nil {
+			return err
+		}
+		for _, timestamp := range timestamps {
+			seen[isuConditionKey{hourly.JIAIsuUUID, timestamp}] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// seenに含まれるコンディションと、バッチ内で二度目以降のコンディションを除く。seenには残したコンディションも加える
+func filterDuplicatedIsuConditions(conditions []IsuCondition, seen map[isuConditionKey]struct{}) []IsuCondition {
+	unique := make([]IsuCondition, 0, len(conditions))
+	for _, condition := range conditions {
+		key := isuConditionKey{condition.JIAIsuUUID, condition.Timestamp.Unix()}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		unique = append(unique, condition)
+	}
+	return unique
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFilterDuplicatedIsuConditions(t *testing.T) {
+	base := time.Date(2021, 8, 1, 10, 0, 0, 0, time.Local)
+	condition := func(jiaIsuUUID string, offset time.Duration, message string) IsuCondition {
+		return IsuCondition{
+			JIAIsuUUID:     jiaIsuUUID,
+			Timestamp:      base.Add(offset),
+			Condition:      "is_dirty=false,is_overweight=false,is_broken=false",
+			ConditionLevel: conditionLevelInfo,
+			Message:        message,
+		}
+	}
+
+	tests := []struct {
+		name       string
+		existing   []IsuCondition
+		conditions []IsuCondition
+		want       []string
+	}{
+		{
+			name:       "no duplicates",
+			conditions: []IsuCondition{condition("a", 0, "1"), condition("a", time.Second, "2"), condition("b", 0, "3")},
+			want:       []string{"1", "2", "3"},
+		},
+		{
+			name:       "first one in a batch wins",
+			conditions: []IsuCondition{condition("a", 0, "1"), condition("a", 0, "2"), condition("a", time.Second, "3")},
+			want:       []string{"1", "3"},
+		},
+		{
+			name:       "already written",
+			existing:   []IsuCondition{condition("a", 0, "old")},
+			conditions: []IsuCondition{condition("a", 0, "1"), condition("b", 0, "2")},
+			want:       []string{"2"},
+		},
+		{
+			name:       "same timestamp on another isu",
+			existing:   []IsuCondition{condition("b", 0, "old")},
+			conditions: []IsuCondition{condition("a", 0, "1")},
+			want:       []string{"1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := map[isuConditionKey]struct{}{}
+			for _, c := range tt.existing {
+				seen[isuConditionKey{c.JIAIsuUUID, c.Timestamp.Unix()}] = struct{}{}
+			}
+			got := filterDuplicatedIsuConditions(tt.conditions, seen)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d conditions, want %d", len(got), len(tt.want))
+			}
+			for i, c := range got {
+				if c.Message != tt.want[i] {
+					t.Errorf("got[%d].Message = %q, want %q", i, c.Message, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// アーカイブして生のコンディションを削除した時間に再送されたコンディションは、集計に残したタイムスタンプで除く
+func TestFilterDuplicatedIsuConditionsAfterArchive(t *testing.T) {
+	base := time.Date(2021, 8, 1, 10, 0, 0, 0, time.Local)
+	original := []IsuCondition{
+		{JIAIsuUUID: "a", Timestamp: base.Add(10 * time.Minute), ConditionLevel: conditionLevelInfo},
+		{JIAIsuUUID: "a", Timestamp: base.Add(20 * time.Minute), ConditionLevel: conditionLevelCritical},
+	}
+	hourlyList, err := aggregateIsuConditionsHourly(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range hourlyList {
+		hourlyList[i].Archived = true
+	}
+
+	seen := map[isuConditionKey]struct{}{}
+	err = addHourlyConditionKeys(seen, hourlyList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resent := []IsuCondition{
+		{JIAIsuUUID: "a", Timestamp: base.Add(20 * time.Minute), ConditionLevel: conditionLevelInfo},
+		{JIAIsuUUID: "a", Timestamp: base.Add(30 * time.Minute), ConditionLevel: conditionLevelInfo},
+	}
+	got := filterDuplicatedIsuConditions(resent, seen)
+	if len(got) != 1 || !got[0].Timestamp.Equal(base.Add(30*time.Minute)) {
+		t.Fatalf("got %v, want only the condition at +30m", got)
+	}
+}
+
+func TestAddHourlyConditionKeysBadFormat(t *testing.T) {
+	err := addHourlyConditionKeys(map[isuConditionKey]struct{}{}, []IsuConditionHourly{{JIAIsuUUID: "a", Timestamps: "1,x"}})
+	if err == nil {
+		t.Fatal("expected an error for a malformed timestamps column")
+	}
+}
+
+func TestSplitInsertIsuConditions(t *testing.T) {
+	errInsert := errors.New("insert failed")
+	errUnreachable := errors.New("unreachable")
+	conditions := []IsuCondition{}
+	for i := 0; i < 8; i++ {
+		conditions = append(conditions, IsuCondition{JIAIsuUUID: "a", Message: strconv.Itoa(i)})
+	}
+
+	tests := []struct {
+		name            string
+		bad             string // この行を含むバッチは書き込めない
+		down            bool   // 最初からDBに接続できない
+		downAfterCommit bool   // 一度書き込めた後はDBに接続できない
+		wantInserted    int
+		wantProcessed   int
+		wantErr         bool
+	}{
+		{name: "all inserted", wantInserted: 8, wantProcessed: 8},
+		{name: "bad row is dropped", bad: "5", wantInserted: 7, wantProcessed: 8},
+		{name: "db is down from the start", down: true, wantProcessed: 0, wantErr: true},
+		// 前半を書き込んだ後、後半を分割する前にDBに接続できなくなる
+		{name: "committed prefix is returned", bad: "7", downAfterCommit: true, wantInserted: 4, wantProcessed: 4, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			down := tt.down
+			insert := func(batch []IsuCondition) ([]IsuCondition, error) {
+				if down {
+					return nil, errUnreachable
+				}
+				for _, c := range batch {
+					if c.Message == tt.bad {
+						return nil, errInsert
+					}
+				}
+				down = tt.downAfterCommit
+				return batch, nil
+			}
+			ping := func() error {
+				if down {
+					return errUnreachable
+				}
+				return nil
+			}
+
+			inserted, processed, err := splitInsertIsuConditions(conditions, insert, ping)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(inserted) != tt.wantInserted {
+				t.Errorf("inserted %d conditions, want %d", len(inserted), tt.wantInserted)
+			}
+			if processed != tt.wantProcessed {
+				t.Errorf("processed = %d, want %d", processed, tt.wantProcessed)
+			}
+		})
+	}
+}
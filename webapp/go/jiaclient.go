@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultJIARequestTimeout   = 3 * time.Second
+	defaultJIAActivateTimeout  = 10 * time.Second
+	defaultJIAMaxAttempts      = 3
+	defaultJIARetryBackoff     = 100 * time.Millisecond
+	defaultJIABreakerThreshold = 5
+	defaultJIABreakerCooldown  = 10 * time.Second
+)
+
+var errJIACircuitOpen = errors.New("JIAService circuit is open")
+
+// JIAが想定外のステータスコードを返した
+type JIAServiceError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *JIAServiceError) Error() string {
+	return fmt.Sprintf("JIAService returned error: status code %v, message: %v", e.StatusCode, e.Body)
+}
+
+// JIAのAPIのクライアント。
+// 一回のリクエストごとのタイムアウト、失敗時のバックオフ付きの再試行、サーキットブレーカーを持つ
+type JIAClient struct {
+	client      *http.Client
+	timeout     time.Duration // 一回のリクエストのタイムアウト
+	maxAttempts int
+	backoff     time.Duration
+	breaker     *CircuitBreaker
+}
+
+func NewJIAClient(timeout time.Duration, maxAttempts int, backoff time.Duration, breaker *CircuitBreaker) *JIAClient {
+	return &JIAClient{
+		client:      &http.Client{},
+		timeout:     timeout,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		breaker:     breaker,
+	}
+}
+
+// ISUをactivateし、JIAから受け取ったISUの情報を返す。
+// activate済みのISUを再度activateしても成功するので、失敗した場合は再試行する
+func (jc *JIAClient) Activate(ctx context.Context, serviceURL string, requestID string, jiaIsuUUID string) (IsuFromJIA, error) {
+	var isuFromJIA IsuFromJIA
+	body := JIAServiceRequest{postIsuConditionTargetBaseURL, jiaIsuUUID}
+	resBody, err := jc.post(ctx, "activate", serviceURL+"/api/activate", requestID, body, jc.maxAttempts,
+		http.StatusAccepted)
+	if err != nil {
+		return isuFromJIA, err
+	}
+
+	err = json.Unmarshal(resBody, &isuFromJIA)
+	if err != nil {
+		return isuFromJIA, fmt.Errorf("bad response from JIAService: %v", err)
+	}
+	return isuFromJIA, nil
+}
+
+// ISUをdeactivateする。既にdeactivate済みのISUは404が返るので、成功として扱う
+func (jc *JIAClient) Deactivate(ctx context.Context, serviceURL string, requestID string, jiaIsuUUID string) error {
+	body := JIAServiceRequest{postIsuConditionTargetBaseURL, jiaIsuUUID}
+	_, err := jc.post(ctx, "deactivate", serviceURL+"/api/deactivate", requestID, body, jc.maxAttempts,
+		http.StatusNoContent, http.StatusNotFound)
+	return err
+}
+
+// JSONをPOSTし、期待するステータスコードであればレスポンスボディを返す。
+// 通信エラーと5xxは再試行し、それ以外のステータスコードは *JIAServiceError を返す
+func (jc *JIAClient) post(ctx context.Context, endpoint string, url string, requestID string, body interface{},
+	maxAttempts int, expectedStatusCodes ...int) ([]byte, error) {
+
+	bodyJSON, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		if !jc.breaker.Allow() {
+			return nil, errJIACircuitOpen
+		}
+
+		statusCode, resBody, err := jc.do(ctx, endpoint, url, requestID, bodyJSON)
+		if err == nil && statusCode < http.StatusInternalServerError {
+			jc.breaker.Success()
+			for _, expected := range expectedStatusCodes {
+				if statusCode == expected {
+					return resBody, nil
+				}
+			}
+			return nil, &JIAServiceError{StatusCode: statusCode, Body: string(resBody)}
+		}
+		jc.breaker.Failure()
+		if err == nil {
+			err = &JIAServiceError{StatusCode: statusCode, Body: string(resBody)}
+		}
+
+		if attempt >= maxAttempts || ctx.Err() != nil {
+			return nil, err
+		}
+		// 再試行の間隔は倍々に延ばし、同時に失敗したリクエストが揃わないよう揺らぎを加える
+		wait := jc.backoff << (attempt - 1)
+		wait += time.Duration(rand.Int63n(int64(wait)/2 + 1))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+func (jc *JIAClient) do(ctx context.Context, endpoint string, url string, requestID string, bodyJSON []byte) (int, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, jc.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(bodyJSON))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if requestID != "" {
+		req.Header.Set(echo.HeaderXRequestID, requestID)
+	}
+
+	start := time.Now()
+	res, err := jc.client.Do(req)
+	if err != nil {
+		jiaRequestDuration.Observe(time.Since(start).Seconds(), endpoint, "error")
+		return 0, nil, fmt.Errorf("failed to request to JIAService: %v", err)
+	}
+	defer res.Body.Close()
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	jiaRequestDuration.Observe(time.Since(start).Seconds(), endpoint, strconv.Itoa(res.StatusCode))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read response from JIAService: %v", err)
+	}
+	return res.StatusCode, resBody, nil
+}
+
+// 連続して失敗した場合に一定時間リクエストを止めるサーキットブレーカー。
+// 止めている時間が過ぎると一つだけリクエストを通し、成功すれば元に戻す
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// リクエストを送ってよいか確認する
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
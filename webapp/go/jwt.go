@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	defaultJIAJWKSPath     = "../jia-jwks.json"
+	defaultJIAJWTLeeway    = 5 * time.Second
+	jiaJWKSReloadInterval  = 5 * time.Second
+	jwtReplayPurgeInterval = time.Minute
+)
+
+// JWKSの一つの鍵
+type JSONWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+type jiaPublicKey struct {
+	alg string
+	key *ecdsa.PublicKey
+}
+
+// JIAのJWTの検証に使う公開鍵の集合。
+// kidを持つトークンはJWKSファイルの鍵で、持たないトークンはPEMファイルの鍵で検証する。
+// JWKSファイルは定期的に読み直すので、JIA側で鍵を切り替えても再起動は不要
+type JIAKeySet struct {
+	mu          sync.RWMutex
+	defaultKey  *ecdsa.PublicKey
+	jwksPath    string
+	jwksModTime time.Time
+	keys        map[string]jiaPublicKey
+}
+
+func NewJIAKeySet(pemPath string, jwksPath string) (*JIAKeySet, error) {
+	pem, err := ioutil.ReadFile(pemPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %v", err)
+	}
+	defaultKey, err := jwt.ParseECPublicKeyFromPEM(pem)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ECDSA public key: %v", err)
+	}
+
+	s := &JIAKeySet{
+		defaultKey: defaultKey,
+		jwksPath:   jwksPath,
+		keys:       map[string]jiaPublicKey{},
+	}
+	err = s.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// JWKSファイルが更新されていれば読み直す。ファイルが無い場合はJWKSの鍵を使わない
+func (s *JIAKeySet) Reload() error {
+	info, err := os.Stat(s.jwksPath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to stat jwks: %v", err)
+		}
+		s.mu.Lock()
+		s.jwksModTime = time.Time{}
+		s.keys = map[string]jiaPublicKey{}
+		s.mu.Unlock()
+		return nil
+	}
+
+	s.mu.RLock()
+	modTime := s.jwksModTime
+	s.mu.RUnlock()
+	if info.ModTime().Equal(modTime) {
+		return nil
+	}
+
+	body, err := ioutil.ReadFile(s.jwksPath)
+	if err != nil {
+		return fmt.Errorf("failed to read jwks: %v", err)
+	}
+	keys, err := parseJWKS(body)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.jwksModTime = info.ModTime()
+	s.keys = keys
+	s.mu.Unlock()
+	return nil
+}
+
+// JWKSファイルを定期的に読み直す
+func (s *JIAKeySet) Run() {
+	ticker := time.NewTicker(jiaJWKSReloadInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := s.Reload()
+		if err != nil {
+			// 読み直しに失敗した場合は以前の鍵を使い続ける
+			log.Errorf("failed to reload jwks: %v", err)
+		}
+	}
+}
+
+// トークンの検証に使う公開鍵を取得
+func (s *JIAKeySet) Key(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
+		return nil, jwt.NewValidationError(fmt.Sprintf("unexpected signing method: %v", token.Header["alg"]), jwt.ValidationErrorSignatureInvalid)
+	}
+
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return s.defaultKey, nil
+	}
+
+	s.mu.RLock()
+	key, ok := s.keys[kid]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, jwt.NewValidationError(fmt.Sprintf("unknown kid: %v", kid), jwt.ValidationErrorUnverifiable)
+	}
+	if key.alg != "" && key.alg != token.Method.Alg() {
+		return nil, jwt.NewValidationError(fmt.Sprintf("unexpected signing method: %v", token.Header["alg"]), jwt.ValidationErrorSignatureInvalid)
+	}
+	return key.key, nil
+}
+
+// JWKSからECDSAの署名検証用の鍵を取り出す
+func parseJWKS(body []byte) (map[string]jiaPublicKey, error) {
+	var jwks JSONWebKeySet
+	err := json.Unmarshal(body, &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("bad format: jwks: %v", err)
+	}
+
+	keys := map[string]jiaPublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "EC" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		if jwk.Kid == "" {
+			return nil, fmt.Errorf("bad format: jwks: missing kid")
+		}
+
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("bad format: jwks: unsupported crv: %v", jwk.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, fmt.Errorf("bad format: jwks: %v: x", jwk.Kid)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, fmt.Errorf("bad format: jwks: %v: y", jwk.Kid)
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("bad format: jwks: %v: invalid point", jwk.Kid)
+		}
+
+		keys[jwk.Kid] = jiaPublicKey{alg: jwk.Alg, key: key}
+	}
+	return keys, nil
+}
+
+// JIAのJWTを検証する
+type JIAJWTVerifier struct {
+	keySet   *JIAKeySet
+	issuer   string // 空の場合は検証しない
+	audience string // 空の場合は検証しない
+	leeway   time.Duration
+
+	mu        sync.Mutex
+	usedJTI   map[string]time.Time // 使用済みのjtiと、そのトークンの有効期限
+	lastPurge time.Time
+}
+
+func NewJIAJWTVerifier(keySet *JIAKeySet, issuer string, audience string, leeway time.Duration) *JIAJWTVerifier {
+	return &JIAJWTVerifier{
+		keySet:    keySet,
+		issuer:    issuer,
+		audience:  audience,
+		leeway:    leeway,
+		usedJTI:   map[string]time.Time{},
+		lastPurge: time.Now(),
+	}
+}
+
+// トークンの署名とクレームを検証する。検証に失敗した場合は *jwt.ValidationError を返す
+func (v *JIAJWTVerifier) Verify(tokenString string) (jwt.MapClaims, error) {
+	// 時刻のずれを許容するため、クレームの検証は自前で行う
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.Parse(tokenString, v.keySet.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, fmt.Errorf("invalid JWT payload")
+	}
+
+	now := time.Now()
+	err = v.validateClaims(claims, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// jtiを含むトークンは一度しか使えない
+	if jti, ok := claims["jti"].(string); ok {
+		exp := time.Unix(int64(claims["exp"].(float64)), 0)
+		if !v.useJTI(jti, exp.Add(v.leeway), now) {
+			return nil, jwt.NewValidationError("token replayed", jwt.ValidationErrorId)
+		}
+	}
+	return claims, nil
+}
+
+func (v *JIAJWTVerifier) validateClaims(claims jwt.MapClaims, now time.Time) error {
+	if _, ok := claims["exp"].(float64); !ok {
+		return jwt.NewValidationError("missing exp", jwt.ValidationErrorExpired)
+	}
+	if !claims.VerifyExpiresAt(now.Add(-v.leeway).Unix(), true) {
+		return jwt.NewValidationError("token is expired", jwt.ValidationErrorExpired)
+	}
+	if !claims.VerifyIssuedAt(now.Add(v.leeway).Unix(), false) {
+		return jwt.NewValidationError("token used before issued", jwt.ValidationErrorIssuedAt)
+	}
+	if !claims.VerifyNotBefore(now.Add(v.leeway).Unix(), false) {
+		return jwt.NewValidationError("token is not valid yet", jwt.ValidationErrorNotValidYet)
+	}
+	if v.issuer != "" && !claims.VerifyIssuer(v.issuer, true) {
+		return jwt.NewValidationError("invalid issuer", jwt.ValidationErrorIssuer)
+	}
+	if v.audience != "" && !hasAudience(claims["aud"], v.audience) {
+		return jwt.NewValidationError("invalid audience", jwt.ValidationErrorAudience)
+	}
+	return nil
+}
+
+// audは文字列か文字列の配列
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jtiを使用済みにする。既に使用済みの場合はfalseを返す
+func (v *JIAJWTVerifier) useJTI(jti string, expiresAt time.Time, now time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if now.Sub(v.lastPurge) > jwtReplayPurgeInterval {
+		for usedJTI, usedExpiresAt := range v.usedJTI {
+			if usedExpiresAt.Before(now) {
+				delete(v.usedJTI, usedJTI)
+			}
+		}
+		v.lastPurge = now
+	}
+
+	if expiresAt, ok := v.usedJTI[jti]; ok && !expiresAt.Before(now) {
+		return false
+	}
+	v.usedJTI[jti] = expiresAt
+	return true
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func newTestECDSAKey(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testJWK(kid string, alg string, key *ecdsa.PrivateKey) JSONWebKey {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	x := make([]byte, size)
+	y := make([]byte, size)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	return JSONWebKey{
+		Kid: kid,
+		Kty: "EC",
+		Alg: alg,
+		Use: "sig",
+		Crv: key.Curve.Params().Name,
+		X:   base64.RawURLEncoding.EncodeToString(x),
+		Y:   base64.RawURLEncoding.EncodeToString(y),
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	p256 := newTestECDSAKey(t, elliptic.P256())
+	p384 := newTestECDSAKey(t, elliptic.P384())
+
+	encKey := testJWK("enc", "ES256", p256)
+	encKey.Use = "enc"
+	rsaKey := JSONWebKey{Kid: "rsa", Kty: "RSA"}
+	noKid := testJWK("", "ES256", p256)
+	badCurve := testJWK("bad-crv", "ES256", p256)
+	badCurve.Crv = "P-192"
+	offCurve := testJWK("off-curve", "ES256", p256)
+	offCurve.Y = offCurve.X
+	badX := testJWK("bad-x", "ES256", p256)
+	badX.X = "!"
+
+	tests := []struct {
+		name     string
+		keys     []JSONWebKey
+		wantKids []string
+		wantErr  bool
+	}{
+		{name: "ec keys", keys: []JSONWebKey{testJWK("a", "ES256", p256), testJWK("b", "ES384", p384)}, wantKids: []string{"a", "b"}},
+		{name: "non signing and non ec keys are skipped", keys: []JSONWebKey{encKey, rsaKey, testJWK("a", "", p256)}, wantKids: []string{"a"}},
+		{name: "missing kid", keys: []JSONWebKey{noKid}, wantErr: true},
+		{name: "unsupported curve", keys: []JSONWebKey{badCurve}, wantErr: true},
+		{name: "point is not on the curve", keys: []JSONWebKey{offCurve}, wantErr: true},
+		{name: "bad coordinate", keys: []JSONWebKey{badX}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(JSONWebKeySet{Keys: tt.keys})
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys, err := parseJWKS(body)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != len(tt.wantKids) {
+				t.Fatalf("got %d keys, want %v", len(keys), tt.wantKids)
+			}
+			for _, kid := range tt.wantKids {
+				if _, ok := keys[kid]; !ok {
+					t.Errorf("missing key %q", kid)
+				}
+			}
+		})
+	}
+
+	if _, err := parseJWKS([]byte("{")); err == nil {
+		t.Error("expected an error for malformed json")
+	}
+}
+
+func TestJIAJWTVerifier(t *testing.T) {
+	defaultKey := newTestECDSAKey(t, elliptic.P256())
+	rotatedKey := newTestECDSAKey(t, elliptic.P256())
+	otherKey := newTestECDSAKey(t, elliptic.P256())
+
+	keys, err := parseJWKS(mustMarshal(t, JSONWebKeySet{Keys: []JSONWebKey{testJWK("rotated", "ES256", rotatedKey)}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keySet := &JIAKeySet{defaultKey: &defaultKey.PublicKey, keys: keys}
+
+	now := time.Now()
+	const leeway = 5 * time.Second
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"jia_user_id": "isucon",
+			"iss":         "jia",
+			"aud":         "isucondition",
+			"iat":         float64(now.Unix()),
+			"exp":         float64(now.Add(time.Minute).Unix()),
+		}
+	}
+	sign := func(method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(method, claims)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	with := func(key string, value interface{}) jwt.MapClaims {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name      string
+		token     string
+		wantError uint32 // jwt.ValidationErrorの種類。0の場合は成功する
+	}{
+		{name: "default key", token: sign(jwt.SigningMethodES256, defaultKey, "", validClaims())},
+		{name: "jwks key", token: sign(jwt.SigningMethodES256, rotatedKey, "rotated", validClaims())},
+		{name: "audience in array", token: sign(jwt.SigningMethodES256, defaultKey, "", with("aud", []interface{}{"other", "isucondition"}))},
+		{name: "expired within leeway", token: sign(jwt.SigningMethodES256, defaultKey, "", with("exp", float64(now.Add(-leeway/2).Unix())))},
+		{name: "expired", token: sign(jwt.SigningMethodES256, defaultKey, "", with("exp", float64(now.Add(-2*leeway).Unix()))), wantError: jwt.ValidationErrorExpired},
+		{name: "missing exp", token: sign(jwt.SigningMethodES256, defaultKey, "", with("exp", nil)), wantError: jwt.ValidationErrorExpired},
+		{name: "not valid yet", token: sign(jwt.SigningMethodES256, defaultKey, "", with("nbf", float64(now.Add(2*leeway).Unix()))), wantError: jwt.ValidationErrorNotValidYet},
+		{name: "issued in the future", token: sign(jwt.SigningMethodES256, defaultKey, "", with("iat", float64(now.Add(2*leeway).Unix()))), wantError: jwt.ValidationErrorIssuedAt},
+		{name: "wrong issuer", token: sign(jwt.SigningMethodES256, defaultKey, "", with("iss", "other")), wantError: jwt.ValidationErrorIssuer},
+		{name: "wrong audience", token: sign(jwt.SigningMethodES256, defaultKey, "", with("aud", "other")), wantError: jwt.ValidationErrorAudience},
+		{name: "unknown kid", token: sign(jwt.SigningMethodES256, rotatedKey, "unknown", validClaims()), wantError: jwt.ValidationErrorUnverifiable},
+		{name: "wrong key", token: sign(jwt.SigningMethodES256, otherKey, "", validClaims()), wantError: jwt.ValidationErrorSignatureInvalid},
+		{name: "hmac", token: sign(jwt.SigningMethodHS256, []byte("secret"), "", validClaims()), wantError: jwt.ValidationErrorSignatureInvalid},
+		{name: "alg does not match jwk", token: sign(jwt.SigningMethodES384, newTestECDSAKey(t, elliptic.P384()), "rotated", validClaims()), wantError: jwt.ValidationErrorSignatureInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := NewJIAJWTVerifier(keySet, "jia", "isucondition", leeway)
+			claims, err := verifier.Verify(tt.token)
+			if tt.wantError == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if claims["jia_user_id"] != "isucon" {
+					t.Errorf("got claims %v", claims)
+				}
+				return
+			}
+
+			var validationErr *jwt.ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("err = %v, want a *jwt.ValidationError", err)
+			}
+			if validationErr.Errors&tt.wantError == 0 {
+				t.Errorf("validation error = %v (%b), want %b", err, validationErr.Errors, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestJIAJWTVerifierReplay(t *testing.T) {
+	key := newTestECDSAKey(t, elliptic.P256())
+	keySet := &JIAKeySet{defaultKey: &key.PublicKey, keys: map[string]jiaPublicKey{}}
+	verifier := NewJIAJWTVerifier(keySet, "", "", time.Second)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"jia_user_id": "isucon",
+		"jti":         "once",
+		"exp":         float64(time.Now().Add(time.Minute).Unix()),
+	})
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := verifier.Verify(s); err != nil {
+		t.Fatal(err)
+	}
+	_, err = verifier.Verify(s)
+	var validationErr *jwt.ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Errors&jwt.ValidationErrorId == 0 {
+		t.Fatalf("second use: err = %v, want a replay error", err)
+	}
+
+	// 有効期限を過ぎたjtiは忘れてよい
+	now := time.Now()
+	if !verifier.useJTI("expired", now.Add(-time.Second), now.Add(-2*time.Second)) {
+		t.Fatal("first use of a jti failed")
+	}
+	if !verifier.useJTI("expired", now.Add(time.Minute), now) {
+		t.Error("a jti whose token has expired should be usable again")
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	body, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
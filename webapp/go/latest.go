@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ISUごとの最新のコンディションをメモリ上に保持する
+type LatestConditionStore struct {
+	mu         sync.RWMutex
+	conditions map[string]IsuCondition
+	version    uint64 // 内容が変わるたびに増える
+}
+
+func NewLatestConditionStore() *LatestConditionStore {
+	return &LatestConditionStore{
+		conditions: map[string]IsuCondition{},
+	}
+}
+
+// ISUの最新のコンディションを取得
+func (s *LatestConditionStore) Get(jiaIsuUUID string) (IsuCondition, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	condition, ok := s.conditions[jiaIsuUUID]
+	return condition, ok
+}
+
+// 書き込まれたコンディションで最新のコンディションを更新する
+func (s *LatestConditionStore) Update(conditions []IsuCondition) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, condition := range conditions {
+		latest, ok := s.conditions[condition.JIAIsuUUID]
+		if !ok || !condition.Timestamp.Before(latest.Timestamp) {
+			s.conditions[condition.JIAIsuUUID] = condition
+			s.version++
+		}
+	}
+}
+
+// ISUの最新のコンディションを削除
+func (s *LatestConditionStore) Delete(jiaIsuUUID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conditions, jiaIsuUUID)
+	s.version++
+}
+
+// 内容の版を取得。版が同じであれば内容も変わっていない
+func (s *LatestConditionStore) Version() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.version
+}
+
+// DBの内容から最新のコンディションを作り直す。アーカイブした時間は集計に残した代表のコンディションを使う
+func (s *LatestConditionStore) Rebuild(db *sqlx.DB) error {
+	rows, err := db.Queryx(
+		"SELECT `c`.* FROM `isu_condition` AS `c`" +
+			"	JOIN (SELECT `jia_isu_uuid`, MAX(`timestamp`) AS `timestamp` FROM `isu_condition` GROUP BY `jia_isu_uuid`) AS `l`" +
+			"	ON `c`.`jia_isu_uuid` = `l`.`jia_isu_uuid` AND `c`.`timestamp` = `l`.`timestamp`")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer rows.Close()
+
+	conditions := map[string]IsuCondition{}
+	for rows.Next() {
+		var condition IsuCondition
+		err = rows.StructScan(&condition)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+
+		latest, ok := conditions[condition.JIAIsuUUID]
+		if !ok || condition.ID > latest.ID {
+			conditions[condition.JIAIsuUUID] = condition
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	// 全てのコンディションをアーカイブしたISUは、最後にアーカイブした時間の代表のコンディションを最新とする
+	archivedList := []IsuConditionHourly{}
+	err = db.Select(&archivedList,
+		"SELECT `h`.* FROM `isu_condition_hourly` AS `h`"+
+			"	JOIN (SELECT `jia_isu_uuid`, MAX(`start_at`) AS `start_at` FROM `isu_condition_hourly` WHERE `archived` = 1 GROUP BY `jia_isu_uuid`) AS `l`"+
+			"	ON `h`.`jia_isu_uuid` = `l`.`jia_isu_uuid` AND `h`.`start_at` = `l`.`start_at`")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	for _, hourly := range archivedList {
+		if !hourly.RepresentativeTimestamp.Valid {
+			continue
+		}
+		latest, ok := conditions[hourly.JIAIsuUUID]
+		if !ok || hourly.RepresentativeTimestamp.Time.After(latest.Timestamp) {
+			conditions[hourly.JIAIsuUUID] = hourly.representativeCondition()
+		}
+	}
+
+	s.mu.Lock()
+	s.conditions = conditions
+	s.version++
+	s.mu.Unlock()
+	return nil
+}
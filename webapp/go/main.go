@@ -1,21 +1,20 @@
 package main
 
 import (
-	"bytes"
-	"crypto/ecdsa"
+	"context"
 	"database/sql"
-	"encoding/json"
+	"encoding/base64"
 	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
 	"os"
-	"os/exec"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-sql-driver/mysql"
@@ -28,10 +27,9 @@ import (
 
 const (
 	sessionName                 = "isucondition_go"
-	conditionLimit              = 20
-	frontendContentsPath        = "../public"
+	conditionMaxLimit           = 100
+	conditionMessageMaxLength   = 255 // isu_condition.messageの長さ
 	jiaJWTSigningKeyPath        = "../ec256-public.pem"
-	defaultIconFilePath         = "../NoImage.jpg"
 	defaultJIAServiceURL        = "http://localhost:5000"
 	mysqlErrNumDuplicateEntry   = 1062
 	conditionLevelInfo          = "info"
@@ -42,12 +40,31 @@ const (
 	scoreConditionLevelCritical = 1
 )
 
+// DATETIMEに書き込めるタイムスタンプの範囲。タイムゾーンの変換でずれても収まるよう一日分狭くしている
+var (
+	conditionMinTimestamp = time.Date(1000, 1, 2, 0, 0, 0, 0, time.UTC).Unix()
+	conditionMaxTimestamp = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC).Unix()
+)
+
 var (
 	db                  *sqlx.DB
+	serverConfig        ServerConfig
 	sessionStore        sessions.Store
+	sessionBackend      SessionBackend
 	mySQLConnectionData *MySQLConnectionEnv
 
-	jiaJWTSigningKey *ecdsa.PublicKey
+	jiaKeySet      *JIAKeySet
+	jiaJWTVerifier *JIAJWTVerifier
+
+	migrator             *Migrator
+	iconStore            *IconStore
+	conditionIngester    *ConditionIngester
+	latestConditionStore *LatestConditionStore
+	trendCache           *TrendCache
+	jiaClient            *JIAClient
+	activationWorker     *ActivationWorker
+	conditionHub         *ConditionHub
+	alertNotifier        *AlertNotifier
 
 	postIsuConditionTargetBaseURL string // JIAへのactivate時に登録する，ISUがconditionを送る先のURL
 )
@@ -58,14 +75,16 @@ type Config struct {
 }
 
 type Isu struct {
-	ID         int       `db:"id" json:"id"`
-	JIAIsuUUID string    `db:"jia_isu_uuid" json:"jia_isu_uuid"`
-	Name       string    `db:"name" json:"name"`
-	Image      []byte    `db:"image" json:"-"`
-	Character  string    `db:"character" json:"character"`
-	JIAUserID  string    `db:"jia_user_id" json:"-"`
-	CreatedAt  time.Time `db:"created_at" json:"-"`
-	UpdatedAt  time.Time `db:"updated_at" json:"-"`
+	ID         int    `db:"id" json:"id"`
+	JIAIsuUUID string `db:"jia_isu_uuid" json:"jia_isu_uuid"`
+	Name       string `db:"name" json:"name"`
+	ImageHash  string `db:"image_hash" json:"-"`
+	Character  string `db:"character" json:"character"`
+	// activateの状態。pending, active, failedのいずれか
+	ActivationStatus string    `db:"activation_status" json:"activation_status"`
+	JIAUserID        string    `db:"jia_user_id" json:"-"`
+	CreatedAt        time.Time `db:"created_at" json:"-"`
+	UpdatedAt        time.Time `db:"updated_at" json:"-"`
 }
 
 type IsuFromJIA struct {
@@ -81,21 +100,32 @@ type GetIsuListResponse struct {
 }
 
 type IsuCondition struct {
-	ID         int       `db:"id"`
-	JIAIsuUUID string    `db:"jia_isu_uuid"`
-	Timestamp  time.Time `db:"timestamp"`
-	IsSitting  bool      `db:"is_sitting"`
-	Condition  string    `db:"condition"`
-	Message    string    `db:"message"`
-	CreatedAt  time.Time `db:"created_at"`
+	ID             int       `db:"id"`
+	JIAIsuUUID     string    `db:"jia_isu_uuid"`
+	Timestamp      time.Time `db:"timestamp"`
+	IsSitting      bool      `db:"is_sitting"`
+	Condition      string    `db:"condition"`
+	IsDirty        bool      `db:"is_dirty"`
+	IsOverweight   bool      `db:"is_overweight"`
+	IsBroken       bool      `db:"is_broken"`
+	ConditionLevel string    `db:"condition_level"`
+	Message        string    `db:"message"`
+	CreatedAt      time.Time `db:"created_at"`
+}
+
+// コンディション一覧のページ位置
+type IsuConditionCursor struct {
+	Timestamp int64
+	ID        int
 }
 
 type MySQLConnectionEnv struct {
-	Host     string
-	Port     string
-	User     string
-	DBName   string
-	Password string
+	Host         string `yaml:"host"`
+	Port         string `yaml:"port"`
+	User         string `yaml:"user"`
+	DBName       string `yaml:"dbname"`
+	Password     string `yaml:"password"`
+	MaxOpenConns int    `yaml:"max_open_conns"`
 }
 
 type InitializeRequest struct {
@@ -129,13 +159,6 @@ type ConditionsPercentage struct {
 	IsOverweight int `json:"is_overweight"`
 }
 
-type GraphDataPointWithInfo struct {
-	JIAIsuUUID          string
-	StartAt             time.Time
-	Data                GraphDataPoint
-	ConditionTimestamps []int64
-}
-
 type GetIsuConditionResponse struct {
 	JIAIsuUUID     string `json:"jia_isu_uuid"`
 	IsuName        string `json:"isu_name"`
@@ -146,6 +169,12 @@ type GetIsuConditionResponse struct {
 	Message        string `json:"message"`
 }
 
+// limitかcursorを指定した場合の GET /api/condition/:jia_isu_uuid のレスポンス
+type GetIsuConditionPageResponse struct {
+	Conditions []*GetIsuConditionResponse `json:"conditions"`
+	NextCursor *string                    `json:"next_cursor"`
+}
+
 type TrendResponse struct {
 	Character string            `json:"character"`
 	Info      []*TrendCondition `json:"info"`
@@ -170,60 +199,92 @@ type JIAServiceRequest struct {
 	IsuUUID       string `json:"isu_uuid"`
 }
 
-func getEnv(key string, defaultValue string) string {
-	val := os.Getenv(key)
-	if val != "" {
-		return val
-	}
-	return defaultValue
-}
-
-func NewMySQLConnectionEnv() *MySQLConnectionEnv {
-	return &MySQLConnectionEnv{
-		Host:     getEnv("MYSQL_HOST", "127.0.0.1"),
-		Port:     getEnv("MYSQL_PORT", "3306"),
-		User:     getEnv("MYSQL_USER", "isucon"),
-		DBName:   getEnv("MYSQL_DBNAME", "isucondition"),
-		Password: getEnv("MYSQL_PASS", "isucon"),
-	}
-}
-
 func (mc *MySQLConnectionEnv) ConnectDB() (*sqlx.DB, error) {
 	dsn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?parseTime=true&loc=Asia%%2FTokyo", mc.User, mc.Password, mc.Host, mc.Port, mc.DBName)
 	return sqlx.Open("mysql", dsn)
 }
 
-func init() {
-	sessionStore = sessions.NewCookieStore([]byte(getEnv("SESSION_KEY", "isucondition")))
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err := runMigrateCommand(os.Args[2:])
+		if err != nil {
+			log.Fatalf("failed to migrate: %v", err)
+		}
+		return
+	}
+
+	configPath := flag.String("config", os.Getenv(configPathEnv), "path to the config file (YAML)")
+	printConfig := flag.Bool("print-config", false, "print the effective config and exit")
+	flag.Parse()
 
-	key, err := ioutil.ReadFile(jiaJWTSigningKeyPath)
+	var err error
+	serverConfig, err = LoadServerConfig(*configPath)
 	if err != nil {
-		log.Fatalf("failed to read file: %v", err)
+		log.Fatalf("failed to load config: %v", err)
+	}
+	if *printConfig {
+		fmt.Print(serverConfig)
+		return
 	}
-	jiaJWTSigningKey, err = jwt.ParseECPublicKeyFromPEM(key)
+
+	sessionStore = sessions.NewCookieStore([]byte(serverConfig.Session.Key))
+
+	jiaKeySet, err = NewJIAKeySet(jiaJWTSigningKeyPath, serverConfig.JIA.JWKSPath)
 	if err != nil {
-		log.Fatalf("failed to parse ECDSA public key: %v", err)
+		log.Fatalf("failed to load JIA public keys: %v", err)
 	}
-}
+	jiaJWTVerifier = NewJIAJWTVerifier(jiaKeySet, serverConfig.JIA.JWTIssuer, serverConfig.JIA.JWTAudience,
+		time.Duration(serverConfig.JIA.JWTLeeway))
 
-func main() {
 	e := echo.New()
 	e.Debug = true
 	e.Logger.SetLevel(log.DEBUG)
 
-	e.Use(middleware.Logger())
+	e.Use(requestIDMiddleware)
+	e.Use(accessLogMiddleware)
 	e.Use(middleware.Recover())
+	e.Use(metricsMiddleware)
 
 	e.POST("/initialize", postInitialize)
 
+	e.GET("/metrics", getMetrics)
+	e.GET("/healthz", getHealthz)
+	e.GET("/readyz", getReadyz)
+
 	e.POST("/api/auth", postAuthentication)
 	e.POST("/api/signout", postSignout)
+	e.POST("/api/signout/all", postSignoutAll)
 	e.GET("/api/user/me", getMe)
 	e.GET("/api/isu", getIsuList)
 	e.POST("/api/isu", postIsu)
+	e.GET("/api/isu/stream", getIsuListConditionStream)
 	e.GET("/api/isu/:jia_isu_uuid", getIsuID)
+	e.PUT("/api/isu/:jia_isu_uuid", patchIsu)
+	e.PATCH("/api/isu/:jia_isu_uuid", patchIsu)
+	e.DELETE("/api/isu/:jia_isu_uuid", deleteIsu)
+	e.POST("/api/isu/:jia_isu_uuid/activate", postIsuActivate)
 	e.GET("/api/isu/:jia_isu_uuid/icon", getIsuIcon)
 	e.GET("/api/isu/:jia_isu_uuid/graph", getIsuGraph)
+	e.GET("/api/isu/:jia_isu_uuid/stream", getIsuConditionStream)
+	e.GET("/api/isu/:jia_isu_uuid/conditions/export", getIsuConditionsExport)
+	e.POST("/api/isu/:jia_isu_uuid/conditions/import", postIsuConditionsImport)
+	e.GET("/api/isu/:jia_isu_uuid/alert", getIsuAlertRules)
+	e.POST("/api/isu/:jia_isu_uuid/alert", postIsuAlertRule)
+	e.DELETE("/api/isu/:jia_isu_uuid/alert/:alert_id", deleteIsuAlertRule)
+	e.GET("/api/isu/:jia_isu_uuid/alert/delivery", getIsuAlertDeliveries)
+	e.GET("/api/isu/:jia_isu_uuid/access", getIsuAccessList)
+	e.POST("/api/isu/:jia_isu_uuid/access/invitation", postIsuAccessInvitation)
+	e.DELETE("/api/isu/:jia_isu_uuid/access/:jia_user_id", deleteIsuAccess)
+	e.POST("/api/invitation/:token/accept", postIsuAccessInvitationAccept)
+	e.GET("/api/group", getIsuGroupList)
+	e.POST("/api/group", postIsuGroup)
+	e.GET("/api/group/:group_id", getIsuGroupID)
+	e.PUT("/api/group/:group_id", patchIsuGroup)
+	e.PATCH("/api/group/:group_id", patchIsuGroup)
+	e.DELETE("/api/group/:group_id", deleteIsuGroup)
+	e.POST("/api/group/:group_id/isu", postIsuGroupMember)
+	e.DELETE("/api/group/:group_id/isu/:jia_isu_uuid", deleteIsuGroupMember)
+	e.GET("/api/group/:group_id/summary", getIsuGroupSummary)
 	e.GET("/api/condition/:jia_isu_uuid", getIsuConditions)
 	e.GET("/api/trend", getTrend)
 
@@ -234,26 +295,89 @@ func main() {
 	e.GET("/isu/:jia_isu_uuid/condition", getIndex)
 	e.GET("/isu/:jia_isu_uuid/graph", getIndex)
 	e.GET("/register", getIndex)
-	e.Static("/assets", frontendContentsPath+"/assets")
+	e.Static("/assets", serverConfig.Paths.FrontendContents+"/assets")
 
-	mySQLConnectionData = NewMySQLConnectionEnv()
+	mySQLConnectionData = &serverConfig.MySQL
 
-	var err error
 	db, err = mySQLConnectionData.ConnectDB()
 	if err != nil {
 		e.Logger.Fatalf("failed to connect db: %v", err)
 		return
 	}
-	db.SetMaxOpenConns(10)
+	db.SetMaxOpenConns(serverConfig.MySQL.MaxOpenConns)
 	defer db.Close()
 
-	postIsuConditionTargetBaseURL = os.Getenv("POST_ISUCONDITION_TARGET_BASE_URL")
-	if postIsuConditionTargetBaseURL == "" {
-		e.Logger.Fatalf("missing: POST_ISUCONDITION_TARGET_BASE_URL")
+	iconStore, err = NewIconStore(serverConfig.Paths.IconDir)
+	if err != nil {
+		e.Logger.Fatalf("failed to open icon store: %v", err)
+		return
+	}
+
+	migrator, err = NewMigrator(db, migrationsPath)
+	if err != nil {
+		e.Logger.Fatalf("failed to load migrations: %v", err)
+		return
+	}
+	_, err = migrator.Up()
+	if err != nil {
+		e.Logger.Fatalf("failed to migrate: %v", err)
+		return
+	}
+
+	sessionBackend, err = NewSessionBackend(serverConfig.Session.Backend, serverConfig.Session.CacheSize, db)
+	if err != nil {
+		e.Logger.Fatalf("failed to create session backend: %v", err)
+		return
+	}
+	go purgeExpiredSessions()
+
+	latestConditionStore = NewLatestConditionStore()
+	err = latestConditionStore.Rebuild(db)
+	if err != nil {
+		e.Logger.Fatalf("failed to load latest conditions: %v", err)
+		return
+	}
+
+	trendCache = NewTrendCache(time.Duration(serverConfig.Trend.CacheTTL))
+
+	jia := serverConfig.JIA
+	jiaClient = NewJIAClient(time.Duration(jia.RequestTimeout), jia.MaxAttempts, time.Duration(jia.RetryBackoff),
+		NewCircuitBreaker(jia.BreakerThreshold, time.Duration(jia.BreakerCooldown)))
+
+	activationWorker = NewActivationWorker(activationQueueCapacity)
+	activationWorker.Run(activationWorkerCount)
+
+	go jiaKeySet.Run()
+
+	conditionHub = NewConditionHub()
+
+	alertNotifier = NewAlertNotifier()
+	go alertNotifier.Run()
+
+	// retention.ageが0の場合はコンディションをアーカイブしない
+	if serverConfig.Retention.Age > 0 {
+		retention, err := NewConditionRetention(time.Duration(serverConfig.Retention.Age), time.Duration(serverConfig.Retention.Interval),
+			serverConfig.Retention.ArchiveDir)
+		if err != nil {
+			e.Logger.Fatalf("failed to start condition retention: %v", err)
+			return
+		}
+		go retention.Run()
+	}
+
+	conditionIngester = NewConditionIngester(serverConfig.Condition.QueueCapacity, serverConfig.Condition.BatchSize,
+		time.Duration(serverConfig.Condition.FlushInterval))
+	go conditionIngester.Run()
+
+	postIsuConditionTargetBaseURL = serverConfig.PostIsuConditionTargetBaseURL
+
+	err = activationWorker.ResumePending()
+	if err != nil {
+		e.Logger.Fatalf("failed to resume activation: %v", err)
 		return
 	}
 
-	serverPort := fmt.Sprintf(":%v", getEnv("SERVER_APP_PORT", "3000"))
+	serverPort := fmt.Sprintf(":%v", serverConfig.Port)
 	e.Logger.Fatal(e.Start(serverPort))
 }
 
@@ -270,30 +394,26 @@ func getUserIDFromSession(c echo.Context) (string, int, error) {
 	if err != nil {
 		return "", http.StatusInternalServerError, fmt.Errorf("failed to get session: %v", err)
 	}
-	_jiaUserID, ok := session.Values["jia_user_id"]
+	sessionID, ok := session.Values[sessionValueKeySessionID].(string)
 	if !ok {
 		return "", http.StatusUnauthorized, fmt.Errorf("no session")
 	}
 
-	jiaUserID := _jiaUserID.(string)
-	var count int
-
-	err = db.Get(&count, "SELECT COUNT(*) FROM `user` WHERE `jia_user_id` = ?",
-		jiaUserID)
+	userSession, ok, err := sessionBackend.Get(sessionID)
 	if err != nil {
-		return "", http.StatusInternalServerError, fmt.Errorf("db error: %v", err)
+		return "", http.StatusInternalServerError, err
 	}
-
-	if count == 0 {
-		return "", http.StatusUnauthorized, fmt.Errorf("not found: user")
+	if !ok || userSession.ExpiresAt.Before(time.Now()) {
+		return "", http.StatusUnauthorized, fmt.Errorf("session expired or revoked")
 	}
 
-	return jiaUserID, 0, nil
+	c.Set(contextKeyJIAUserID, userSession.JIAUserID)
+	return userSession.JIAUserID, 0, nil
 }
 
-func getJIAServiceURL(tx *sqlx.Tx) string {
+func getJIAServiceURL(q sqlx.Queryer) string {
 	var config Config
-	err := tx.Get(&config, "SELECT * FROM `isu_association_config` WHERE `name` = ?", "jia_service_url")
+	err := sqlx.Get(q, &config, "SELECT * FROM `isu_association_config` WHERE `name` = ?", "jia_service_url")
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			log.Print(err)
@@ -312,12 +432,19 @@ func postInitialize(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "bad request body")
 	}
 
-	cmd := exec.Command("../sql/init.sh")
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stderr
-	err = cmd.Run()
+	conditionIngester.Reset()
+	alertNotifier.Reset()
+	activationWorker.Reset()
+
+	err = sessionBackend.Reset()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = migrator.Reset()
 	if err != nil {
-		c.Logger().Errorf("exec init.sh error: %v", err)
+		c.Logger().Errorf("failed to reset db: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
@@ -331,6 +458,13 @@ func postInitialize(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	err = latestConditionStore.Rebuild(db)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	trendCache.Reset()
+
 	return c.JSON(http.StatusOK, InitializeResponse{
 		Language: "go",
 	})
@@ -341,12 +475,7 @@ func postInitialize(c echo.Context) error {
 func postAuthentication(c echo.Context) error {
 	reqJwt := strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
 
-	token, err := jwt.Parse(reqJwt, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
-			return nil, jwt.NewValidationError(fmt.Sprintf("unexpected signing method: %v", token.Header["alg"]), jwt.ValidationErrorSignatureInvalid)
-		}
-		return jiaJWTSigningKey, nil
-	})
+	claims, err := jiaJWTVerifier.Verify(reqJwt)
 	if err != nil {
 		switch err.(type) {
 		case *jwt.ValidationError:
@@ -357,11 +486,6 @@ func postAuthentication(c echo.Context) error {
 		}
 	}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		c.Logger().Errorf("invalid JWT payload")
-		return c.NoContent(http.StatusInternalServerError)
-	}
 	jiaUserIDVar, ok := claims["jia_user_id"]
 	if !ok {
 		return c.String(http.StatusBadRequest, "invalid JWT payload")
@@ -370,6 +494,7 @@ func postAuthentication(c echo.Context) error {
 	if !ok {
 		return c.String(http.StatusBadRequest, "invalid JWT payload")
 	}
+	c.Set(contextKeyJIAUserID, jiaUserID)
 
 	_, err = db.Exec("INSERT IGNORE INTO user (`jia_user_id`) VALUES (?)", jiaUserID)
 	if err != nil {
@@ -377,14 +502,7 @@ func postAuthentication(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	session, err := getSession(c.Request())
-	if err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	session.Values["jia_user_id"] = jiaUserID
-	err = session.Save(c.Request(), c.Response())
+	err = startSession(c, jiaUserID)
 	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -406,14 +524,7 @@ func postSignout(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	session, err := getSession(c.Request())
-	if err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	session.Options = &sessions.Options{MaxAge: -1, Path: "/"}
-	err = session.Save(c.Request(), c.Response())
+	err = endSession(c)
 	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -452,17 +563,11 @@ func getIsuList(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	tx, err := db.Beginx()
-	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	defer tx.Rollback()
-
 	isuList := []Isu{}
-	err = tx.Select(
+	err = db.Select(
 		&isuList,
-		"SELECT * FROM `isu` WHERE `jia_user_id` = ? ORDER BY `id` DESC",
+		"SELECT `isu`.* FROM `isu` JOIN `isu_access` ON `isu`.`jia_isu_uuid` = `isu_access`.`jia_isu_uuid`"+
+			"	WHERE `isu_access`.`jia_user_id` = ? ORDER BY `isu`.`id` DESC",
 		jiaUserID)
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
@@ -471,34 +576,16 @@ func getIsuList(c echo.Context) error {
 
 	responseList := []GetIsuListResponse{}
 	for _, isu := range isuList {
-		var lastCondition IsuCondition
-		foundLastCondition := true
-		err = tx.Get(&lastCondition, "SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ? ORDER BY `timestamp` DESC LIMIT 1",
-			isu.JIAIsuUUID)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				foundLastCondition = false
-			} else {
-				c.Logger().Errorf("db error: %v", err)
-				return c.NoContent(http.StatusInternalServerError)
-			}
-		}
-
 		var formattedCondition *GetIsuConditionResponse
+		lastCondition, foundLastCondition := latestConditionStore.Get(isu.JIAIsuUUID)
 		if foundLastCondition {
-			conditionLevel, err := calculateConditionLevel(lastCondition.Condition)
-			if err != nil {
-				c.Logger().Error(err)
-				return c.NoContent(http.StatusInternalServerError)
-			}
-
 			formattedCondition = &GetIsuConditionResponse{
 				JIAIsuUUID:     lastCondition.JIAIsuUUID,
 				IsuName:        isu.Name,
 				Timestamp:      lastCondition.Timestamp.Unix(),
 				IsSitting:      lastCondition.IsSitting,
 				Condition:      lastCondition.Condition,
-				ConditionLevel: conditionLevel,
+				ConditionLevel: lastCondition.ConditionLevel,
 				Message:        lastCondition.Message,
 			}
 		}
@@ -512,17 +599,11 @@ func getIsuList(c echo.Context) error {
 		responseList = append(responseList, res)
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
 	return c.JSON(http.StatusOK, responseList)
 }
 
 // POST /api/isu
-// ISUを登録
+// ISUを登録。asyncの場合はactivateを待たずに202を返す
 func postIsu(c echo.Context) error {
 	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
 	if err != nil {
@@ -549,7 +630,7 @@ func postIsu(c echo.Context) error {
 	var image []byte
 
 	if useDefaultImage {
-		image, err = ioutil.ReadFile(defaultIconFilePath)
+		image, err = ioutil.ReadFile(serverConfig.Paths.DefaultIconFile)
 		if err != nil {
 			c.Logger().Error(err)
 			return c.NoContent(http.StatusInternalServerError)
@@ -569,6 +650,12 @@ func postIsu(c echo.Context) error {
 		}
 	}
 
+	imageHash, err := iconStore.Put(image)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
 	tx, err := db.Beginx()
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
@@ -576,9 +663,10 @@ func postIsu(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	// activateが終わるまでの間も一覧などから読めるよう、性格は空で登録しておく
 	_, err = tx.Exec("INSERT INTO `isu`"+
-		"	(`jia_isu_uuid`, `name`, `image`, `jia_user_id`) VALUES (?, ?, ?, ?)",
-		jiaIsuUUID, isuName, image, jiaUserID)
+		"	(`jia_isu_uuid`, `name`, `image_hash`, `character`, `activation_status`, `jia_user_id`) VALUES (?, ?, ?, '', ?, ?)",
+		jiaIsuUUID, isuName, imageHash, isuActivationPending, jiaUserID)
 	if err != nil {
 		mysqlErr, ok := err.(*mysql.MySQLError)
 
@@ -590,54 +678,78 @@ func postIsu(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	targetURL := getJIAServiceURL(tx) + "/api/activate"
-	body := JIAServiceRequest{postIsuConditionTargetBaseURL, jiaIsuUUID}
-	bodyJSON, err := json.Marshal(body)
+	_, err = tx.Exec("INSERT INTO `isu_access` (`jia_isu_uuid`, `jia_user_id`, `role`) VALUES (?, ?, ?)",
+		jiaIsuUUID, jiaUserID, isuRoleOwner)
 	if err != nil {
-		c.Logger().Error(err)
+		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	reqJIA, err := http.NewRequest(http.MethodPost, targetURL, bytes.NewBuffer(bodyJSON))
+	err = tx.Commit()
 	if err != nil {
-		c.Logger().Error(err)
+		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	reqJIA.Header.Set("Content-Type", "application/json")
-	res, err := http.DefaultClient.Do(reqJIA)
-	if err != nil {
-		c.Logger().Errorf("failed to request to JIAService: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	defer res.Body.Close()
+	if serverConfig.IsuActivationMode == isuActivationModeAsync {
+		err = activationWorker.Enqueue(jiaIsuUUID, getRequestID(c))
+		if err != nil {
+			rollbackErr := deleteUnactivatedIsu(jiaIsuUUID, jiaUserID)
+			if rollbackErr != nil {
+				c.Logger().Errorf("failed to roll back isu: %v", rollbackErr)
+			}
+			c.Logger().Error(err)
+			return c.String(http.StatusServiceUnavailable, "activation queue is full")
+		}
 
-	resBody, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
+		var isu Isu
+		err = db.Get(
+			&isu,
+			"SELECT * FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
+			jiaUserID, jiaIsuUUID)
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
 
-	if res.StatusCode != http.StatusAccepted {
-		c.Logger().Errorf("JIAService returned error: status code %v, message: %v", res.StatusCode, string(resBody))
-		return c.String(res.StatusCode, "JIAService returned error")
+		return c.JSON(http.StatusAccepted, isu)
 	}
 
-	var isuFromJIA IsuFromJIA
-	err = json.Unmarshal(resBody, &isuFromJIA)
+	// JIAの応答を待つ間はトランザクションを開いたままにしない。
+	// activateに失敗した場合は登録したISUを削除して元に戻す
+	ctx, cancel := context.WithTimeout(c.Request().Context(), time.Duration(serverConfig.JIA.ActivateTimeout))
+	defer cancel()
+	isuFromJIA, err := jiaClient.Activate(ctx, getJIAServiceURL(db), getRequestID(c), jiaIsuUUID)
 	if err != nil {
-		c.Logger().Error(err)
+		rollbackErr := deleteUnactivatedIsu(jiaIsuUUID, jiaUserID)
+		if rollbackErr != nil {
+			c.Logger().Errorf("failed to roll back isu: %v", rollbackErr)
+		}
+
+		var jiaErr *JIAServiceError
+		if errors.As(err, &jiaErr) && jiaErr.StatusCode < http.StatusInternalServerError {
+			c.Logger().Error(err)
+			return c.String(jiaErr.StatusCode, "JIAService returned error")
+		}
+		// activateされたか分からないので、ISUがコンディションを送り続けないようdeactivateしておく
+		go deactivateIsuQuietly(getRequestID(c), jiaIsuUUID)
+
+		c.Logger().Errorf("failed to activate isu: %v", err)
+		if errors.Is(err, errJIACircuitOpen) {
+			return c.String(http.StatusServiceUnavailable, "JIAService is unavailable")
+		}
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	_, err = tx.Exec("UPDATE `isu` SET `character` = ? WHERE  `jia_isu_uuid` = ?", isuFromJIA.Character, jiaIsuUUID)
+	_, err = db.Exec("UPDATE `isu` SET `character` = ?, `activation_status` = ? WHERE  `jia_isu_uuid` = ?",
+		isuFromJIA.Character, isuActivationActive, jiaIsuUUID)
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
 	var isu Isu
-	err = tx.Get(
+	err = db.Get(
 		&isu,
 		"SELECT * FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
 		jiaUserID, jiaIsuUUID)
@@ -646,13 +758,40 @@ func postIsu(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	return c.JSON(http.StatusCreated, isu)
+}
+
+// activateできなかったISUの登録を取り消す
+func deleteUnactivatedIsu(jiaIsuUUID string, jiaUserID string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM `isu_access` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	_, err = tx.Exec("DELETE FROM `isu` WHERE `jia_isu_uuid` = ? AND `jia_user_id` = ?", jiaIsuUUID, jiaUserID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
 	err = tx.Commit()
 	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return fmt.Errorf("db error: %v", err)
 	}
+	return nil
+}
 
-	return c.JSON(http.StatusCreated, isu)
+func deactivateIsuQuietly(requestID string, jiaIsuUUID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(serverConfig.JIA.ActivateTimeout))
+	defer cancel()
+	err := jiaClient.Deactivate(ctx, getJIAServiceURL(db), requestID, jiaIsuUUID)
+	if err != nil {
+		log.Errorf("failed to deactivate isu: %v", err)
+	}
 }
 
 // GET /api/isu/:jia_isu_uuid
@@ -670,9 +809,21 @@ func getIsuID(c echo.Context) error {
 
 	jiaIsuUUID := c.Param("jia_isu_uuid")
 
+	_, errStatusCode, err = authorizeIsu(db, jiaUserID, jiaIsuUUID, isuRoleViewer)
+	if err != nil {
+		if errStatusCode == http.StatusNotFound {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, "forbidden")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
 	var res Isu
-	err = db.Get(&res, "SELECT * FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
-		jiaUserID, jiaIsuUUID)
+	err = db.Get(&res, "SELECT * FROM `isu` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return c.String(http.StatusNotFound, "not found: isu")
@@ -685,9 +836,9 @@ func getIsuID(c echo.Context) error {
 	return c.JSON(http.StatusOK, res)
 }
 
-// GET /api/isu/:jia_isu_uuid/icon
-// ISUのアイコンを取得
-func getIsuIcon(c echo.Context) error {
+// PATCH /api/isu/:jia_isu_uuid
+// ISUの名前とアイコンを更新
+func patchIsu(c echo.Context) error {
 	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
 	if err != nil {
 		if errStatusCode == http.StatusUnauthorized {
@@ -700,9 +851,70 @@ func getIsuIcon(c echo.Context) error {
 
 	jiaIsuUUID := c.Param("jia_isu_uuid")
 
-	var image []byte
-	err = db.Get(&image, "SELECT `image` FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
-		jiaUserID, jiaIsuUUID)
+	form, err := c.FormParams()
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	isuNames, updateName := form["isu_name"]
+	if updateName && (len(isuNames) != 1 || isuNames[0] == "") {
+		return c.String(http.StatusBadRequest, "bad format: isu_name")
+	}
+
+	var imageHash string
+	updateImage := true
+	fh, err := c.FormFile("image")
+	if err != nil {
+		if !errors.Is(err, http.ErrMissingFile) {
+			return c.String(http.StatusBadRequest, "bad format: icon")
+		}
+		updateImage = false
+	}
+	if updateImage {
+		file, err := fh.Open()
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		defer file.Close()
+
+		image, err := ioutil.ReadAll(file)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		imageHash, err = iconStore.Put(image)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	if !updateName && !updateImage {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	_, errStatusCode, err = authorizeIsu(tx, jiaUserID, jiaIsuUUID, isuRoleEditor)
+	if err != nil {
+		if errStatusCode == http.StatusNotFound {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, "forbidden")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var isu Isu
+	err = tx.Get(&isu, "SELECT * FROM `isu` WHERE `jia_isu_uuid` = ? FOR UPDATE", jiaIsuUUID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return c.String(http.StatusNotFound, "not found: isu")
@@ -712,12 +924,35 @@ func getIsuIcon(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	return c.Blob(http.StatusOK, "", image)
+	if updateName {
+		isu.Name = isuNames[0]
+	}
+	if updateImage {
+		isu.ImageHash = imageHash
+	}
+
+	_, err = tx.Exec("UPDATE `isu` SET `name` = ?, `image_hash` = ? WHERE `id` = ?",
+		isu.Name, isu.ImageHash, isu.ID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if updateName {
+		conditionHub.Rename(jiaIsuUUID, isu.Name)
+	}
+
+	return c.JSON(http.StatusOK, isu)
 }
 
-// GET /api/isu/:jia_isu_uuid/graph
-// ISUのコンディショングラフ描画のための情報を取得
-func getIsuGraph(c echo.Context) error {
+// DELETE /api/isu/:jia_isu_uuid
+// ISUの登録を解除し、コンディションの履歴を削除
+func deleteIsu(c echo.Context) error {
 	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
 	if err != nil {
 		if errStatusCode == http.StatusUnauthorized {
@@ -729,15 +964,38 @@ func getIsuGraph(c echo.Context) error {
 	}
 
 	jiaIsuUUID := c.Param("jia_isu_uuid")
-	datetimeStr := c.QueryParam("datetime")
-	if datetimeStr == "" {
-		return c.String(http.StatusBadRequest, "missing: datetime")
+
+	_, errStatusCode, err = authorizeIsu(db, jiaUserID, jiaIsuUUID, isuRoleOwner)
+	if err != nil {
+		if errStatusCode == http.StatusNotFound {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, "forbidden")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
 	}
-	datetimeInt64, err := strconv.ParseInt(datetimeStr, 10, 64)
+
+	// JIAの応答を待つ間はトランザクションを開いたままにしない。
+	// deactivateの後に登録解除に失敗しても、既にdeactivate済みのISUは成功として扱うので再度削除できる
+	ctx, cancel := context.WithTimeout(c.Request().Context(), time.Duration(serverConfig.JIA.ActivateTimeout))
+	defer cancel()
+	err = jiaClient.Deactivate(ctx, getJIAServiceURL(db), getRequestID(c), jiaIsuUUID)
 	if err != nil {
-		return c.String(http.StatusBadRequest, "bad format: datetime")
+		var jiaErr *JIAServiceError
+		if errors.As(err, &jiaErr) {
+			c.Logger().Error(err)
+			return c.String(jiaErr.StatusCode, "JIAService returned error")
+		}
+
+		c.Logger().Errorf("failed to deactivate isu: %v", err)
+		if errors.Is(err, errJIACircuitOpen) {
+			return c.String(http.StatusServiceUnavailable, "JIAService is unavailable")
+		}
+		return c.NoContent(http.StatusInternalServerError)
 	}
-	date := time.Unix(datetimeInt64, 0).Truncate(time.Hour)
 
 	tx, err := db.Beginx()
 	if err != nil {
@@ -746,9 +1004,9 @@ func getIsuGraph(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	// deactivateしている間に他のリクエストで削除された場合
 	var count int
-	err = tx.Get(&count, "SELECT COUNT(*) FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
-		jiaUserID, jiaIsuUUID)
+	err = tx.Get(&count, "SELECT COUNT(*) FROM `isu` WHERE `jia_isu_uuid` = ? FOR UPDATE", jiaIsuUUID)
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -757,10 +1015,13 @@ func getIsuGraph(c echo.Context) error {
 		return c.String(http.StatusNotFound, "not found: isu")
 	}
 
-	res, err := generateIsuGraphResponse(tx, jiaIsuUUID, date)
-	if err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+	for _, table := range []string{"isu_condition", "isu_condition_hourly", "isu_alert_rule", "isu_alert_delivery", "isu_group_member",
+		"isu_access", "isu_access_invitation", "isu"} {
+		_, err = tx.Exec("DELETE FROM `"+table+"` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
 	}
 
 	err = tx.Commit()
@@ -769,175 +1030,222 @@ func getIsuGraph(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	return c.JSON(http.StatusOK, res)
-}
+	// コミットより前に破棄すると、その間に届いたコンディションが書き込まれてしまう
+	conditionIngester.Discard(jiaIsuUUID)
+	latestConditionStore.Delete(jiaIsuUUID)
+	trendCache.Reset()
+	conditionHub.RevokeIsu(jiaIsuUUID)
 
-// グラフのデータ点を一日分生成
-func generateIsuGraphResponse(tx *sqlx.Tx, jiaIsuUUID string, graphDate time.Time) ([]GraphResponse, error) {
-	dataPoints := []GraphDataPointWithInfo{}
-	conditionsInThisHour := []IsuCondition{}
-	timestampsInThisHour := []int64{}
-	var startTimeInThisHour time.Time
-	var condition IsuCondition
+	return c.NoContent(http.StatusNoContent)
+}
 
-	rows, err := tx.Queryx("SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ? ORDER BY `timestamp` ASC", jiaIsuUUID)
+// GET /api/isu/:jia_isu_uuid/icon
+// ISUのアイコンを取得
+func getIsuIcon(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
 	if err != nil {
-		return nil, fmt.Errorf("db error: %v", err)
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	for rows.Next() {
-		err = rows.StructScan(&condition)
-		if err != nil {
-			return nil, err
-		}
-
-		truncatedConditionTime := condition.Timestamp.Truncate(time.Hour)
-		if truncatedConditionTime != startTimeInThisHour {
-			if len(conditionsInThisHour) > 0 {
-				data, err := calculateGraphDataPoint(conditionsInThisHour)
-				if err != nil {
-					return nil, err
-				}
-
-				dataPoints = append(dataPoints,
-					GraphDataPointWithInfo{
-						JIAIsuUUID:          jiaIsuUUID,
-						StartAt:             startTimeInThisHour,
-						Data:                data,
-						ConditionTimestamps: timestampsInThisHour})
-			}
+	jiaIsuUUID := c.Param("jia_isu_uuid")
 
-			startTimeInThisHour = truncatedConditionTime
-			conditionsInThisHour = []IsuCondition{}
-			timestampsInThisHour = []int64{}
+	_, errStatusCode, err = authorizeIsu(db, jiaUserID, jiaIsuUUID, isuRoleViewer)
+	if err != nil {
+		if errStatusCode == http.StatusNotFound {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, "forbidden")
 		}
-		conditionsInThisHour = append(conditionsInThisHour, condition)
-		timestampsInThisHour = append(timestampsInThisHour, condition.Timestamp.Unix())
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	if len(conditionsInThisHour) > 0 {
-		data, err := calculateGraphDataPoint(conditionsInThisHour)
-		if err != nil {
-			return nil, err
+	var imageHash string
+	err = db.Get(&imageHash, "SELECT `image_hash` FROM `isu` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: isu")
 		}
 
-		dataPoints = append(dataPoints,
-			GraphDataPointWithInfo{
-				JIAIsuUUID:          jiaIsuUUID,
-				StartAt:             startTimeInThisHour,
-				Data:                data,
-				ConditionTimestamps: timestampsInThisHour})
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	endTime := graphDate.Add(time.Hour * 24)
-	startIndex := len(dataPoints)
-	endNextIndex := len(dataPoints)
-	for i, graph := range dataPoints {
-		if startIndex == len(dataPoints) && !graph.StartAt.Before(graphDate) {
-			startIndex = i
-		}
-		if endNextIndex == len(dataPoints) && graph.StartAt.After(endTime) {
-			endNextIndex = i
-		}
+	// アイコンは内容のハッシュで保存しているので、ハッシュをそのままETagとして使える
+	etag := `"` + imageHash + `"`
+	c.Response().Header().Set("ETag", etag)
+	c.Response().Header().Set("Cache-Control", "private, no-cache")
+	if matchETag(c.Request().Header.Get("If-None-Match"), etag) {
+		return c.NoContent(http.StatusNotModified)
 	}
 
-	filteredDataPoints := []GraphDataPointWithInfo{}
-	if startIndex < endNextIndex {
-		filteredDataPoints = dataPoints[startIndex:endNextIndex]
+	image, err := iconStore.Get(imageHash)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	responseList := []GraphResponse{}
-	index := 0
-	thisTime := graphDate
+	return c.Blob(http.StatusOK, http.DetectContentType(image), image)
+}
 
-	for thisTime.Before(graphDate.Add(time.Hour * 24)) {
-		var data *GraphDataPoint
-		timestamps := []int64{}
+// GET /api/isu/:jia_isu_uuid/graph
+// ISUのコンディショングラフ描画のための情報を取得
+func getIsuGraph(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
 
-		if index < len(filteredDataPoints) {
-			dataWithInfo := filteredDataPoints[index]
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
 
-			if dataWithInfo.StartAt.Equal(thisTime) {
-				data = &dataWithInfo.Data
-				timestamps = dataWithInfo.ConditionTimestamps
-				index++
-			}
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+
+	// datetimeを指定した場合はその時刻から24時間分、
+	// start_timeとend_timeを指定した場合はその期間をresolutionごとに区切って返す
+	var startTime, endTime time.Time
+	bucketSize := time.Hour
+	datetimeStr := c.QueryParam("datetime")
+	if datetimeStr != "" {
+		datetimeInt64, err := strconv.ParseInt(datetimeStr, 10, 64)
+		if err != nil || datetimeInt64 < conditionMinTimestamp || conditionMaxTimestamp < datetimeInt64 {
+			return c.String(http.StatusBadRequest, "bad format: datetime")
+		}
+		startTime = time.Unix(datetimeInt64, 0).Truncate(time.Hour)
+		endTime = startTime.Add(24 * time.Hour)
+	} else {
+		startTimeStr := c.QueryParam("start_time")
+		if startTimeStr == "" {
+			return c.String(http.StatusBadRequest, "missing: datetime")
+		}
+		startTimeInt64, err := strconv.ParseInt(startTimeStr, 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: start_time")
+		}
+		if startTimeInt64 < conditionMinTimestamp || conditionMaxTimestamp < startTimeInt64 {
+			return c.String(http.StatusBadRequest, "bad format: start_time")
+		}
+		endTimeInt64, err := strconv.ParseInt(c.QueryParam("end_time"), 10, 64)
+		if err != nil || endTimeInt64 <= startTimeInt64 || conditionMaxTimestamp < endTimeInt64 {
+			return c.String(http.StatusBadRequest, "bad format: end_time")
 		}
 
-		resp := GraphResponse{
-			StartAt:             thisTime.Unix(),
-			EndAt:               thisTime.Add(time.Hour).Unix(),
-			Data:                data,
-			ConditionTimestamps: timestamps,
+		resolution := c.QueryParam("resolution")
+		if resolution == "" {
+			resolution = graphResolutionHour
+		}
+		var ok bool
+		bucketSize, ok = graphBucketSizes[resolution]
+		if !ok {
+			return c.String(http.StatusBadRequest, "bad format: resolution")
 		}
-		responseList = append(responseList, resp)
 
-		thisTime = thisTime.Add(time.Hour)
+		// 1時間より長い区間も時間ごとの集計を束ねて作るので、1時間単位で揃える
+		truncateUnit := bucketSize
+		if truncateUnit > time.Hour {
+			truncateUnit = time.Hour
+		}
+		startTime = time.Unix(startTimeInt64, 0).Truncate(truncateUnit)
+		// 長い期間ではtime.Durationが溢れるので、秒単位で計算する
+		bucketSeconds := int64(bucketSize / time.Second)
+		points := (endTimeInt64 - startTime.Unix() + bucketSeconds - 1) / bucketSeconds
+		if points <= 0 {
+			return c.String(http.StatusBadRequest, "bad format: end_time")
+		}
+		if points > graphMaxPoints {
+			return c.String(http.StatusBadRequest, "too many points")
+		}
+		endTime = startTime.Add(time.Duration(points) * bucketSize)
 	}
 
-	return responseList, nil
-}
-
-// 複数のISUのコンディションからグラフの一つのデータ点を計算
-func calculateGraphDataPoint(isuConditions []IsuCondition) (GraphDataPoint, error) {
-	conditionsCount := map[string]int{"is_broken": 0, "is_dirty": 0, "is_overweight": 0}
-	rawScore := 0
-	for _, condition := range isuConditions {
-		badConditionsCount := 0
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
 
-		if !isValidConditionFormat(condition.Condition) {
-			return GraphDataPoint{}, fmt.Errorf("invalid condition format")
+	_, errStatusCode, err = authorizeIsu(tx, jiaUserID, jiaIsuUUID, isuRoleViewer)
+	if err != nil {
+		if errStatusCode == http.StatusNotFound {
+			return c.String(http.StatusNotFound, "not found: isu")
 		}
-
-		for _, condStr := range strings.Split(condition.Condition, ",") {
-			keyValue := strings.Split(condStr, "=")
-
-			conditionName := keyValue[0]
-			if keyValue[1] == "true" {
-				conditionsCount[conditionName] += 1
-				badConditionsCount++
-			}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, "forbidden")
 		}
 
-		if badConditionsCount >= 3 {
-			rawScore += scoreConditionLevelCritical
-		} else if badConditionsCount >= 1 {
-			rawScore += scoreConditionLevelWarning
-		} else {
-			rawScore += scoreConditionLevelInfo
-		}
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	sittingCount := 0
-	for _, condition := range isuConditions {
-		if condition.IsSitting {
-			sittingCount++
-		}
+	res, err := generateIsuGraphResponse(tx, jiaIsuUUID, startTime, endTime, bucketSize)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	isuConditionsLength := len(isuConditions)
+	err = tx.Commit()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// グラフのデータ点を一日分生成
+func generateIsuGraphResponse(tx *sqlx.Tx, jiaIsuUUID string, startTime time.Time, endTime time.Time, bucketSize time.Duration) ([]GraphResponse, error) {
+	var buckets []*IsuConditionHourly
+	var err error
+	if bucketSize < time.Hour {
+		buckets, err = aggregateIsuConditionsByBucket(tx, jiaIsuUUID, startTime, endTime, bucketSize)
+	} else {
+		buckets, err = mergeIsuConditionsHourlyByBucket(tx, jiaIsuUUID, startTime, endTime, bucketSize)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	score := rawScore * 100 / 3 / isuConditionsLength
+	responseList := []GraphResponse{}
+	for i, bucket := range buckets {
+		thisTime := startTime.Add(time.Duration(i) * bucketSize)
 
-	sittingPercentage := sittingCount * 100 / isuConditionsLength
-	isBrokenPercentage := conditionsCount["is_broken"] * 100 / isuConditionsLength
-	isOverweightPercentage := conditionsCount["is_overweight"] * 100 / isuConditionsLength
-	isDirtyPercentage := conditionsCount["is_dirty"] * 100 / isuConditionsLength
+		var data *GraphDataPoint
+		timestamps := []int64{}
+		if bucket != nil {
+			dataPoint := bucket.graphDataPoint()
+			data = &dataPoint
+			timestamps, err = bucket.conditionTimestamps()
+			if err != nil {
+				return nil, err
+			}
+		}
 
-	dataPoint := GraphDataPoint{
-		Score: score,
-		Percentage: ConditionsPercentage{
-			Sitting:      sittingPercentage,
-			IsBroken:     isBrokenPercentage,
-			IsOverweight: isOverweightPercentage,
-			IsDirty:      isDirtyPercentage,
-		},
+		resp := GraphResponse{
+			StartAt:             thisTime.Unix(),
+			EndAt:               thisTime.Add(bucketSize).Unix(),
+			Data:                data,
+			ConditionTimestamps: timestamps,
+		}
+		responseList = append(responseList, resp)
 	}
-	return dataPoint, nil
+
+	return responseList, nil
 }
 
 // GET /api/condition/:jia_isu_uuid
-// ISUのコンディションを取得
+// ISUのコンディションを取得。
+// limitかcursorを指定した場合は {"conditions": [...], "next_cursor": ...} を返し、next_cursorをcursorに指定すると次のページを取得できる。
+// どちらも指定しない場合は、これまでのクライアントのためにコンディションの配列だけを返す
 func getIsuConditions(c echo.Context) error {
 	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
 	if err != nil {
@@ -978,11 +1286,40 @@ func getIsuConditions(c echo.Context) error {
 		startTime = time.Unix(startTimeInt64, 0)
 	}
 
+	limit := serverConfig.Condition.Limit
+	limitStr := c.QueryParam("limit")
+	cursorStr := c.QueryParam("cursor")
+	paginated := limitStr != "" || cursorStr != ""
+	if limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || conditionMaxLimit < limit {
+			return c.String(http.StatusBadRequest, "bad format: limit")
+		}
+	}
+
+	var cursor *IsuConditionCursor
+	if cursorStr != "" {
+		cursor, err = decodeIsuConditionCursor(cursorStr)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: cursor")
+		}
+	}
+
+	_, errStatusCode, err = authorizeIsu(db, jiaUserID, jiaIsuUUID, isuRoleViewer)
+	if err != nil {
+		if errStatusCode == http.StatusNotFound {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, "forbidden")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
 	var isuName string
-	err = db.Get(&isuName,
-		"SELECT name FROM `isu` WHERE `jia_isu_uuid` = ? AND `jia_user_id` = ?",
-		jiaIsuUUID, jiaUserID,
-	)
+	err = db.Get(&isuName, "SELECT name FROM `isu` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return c.String(http.StatusNotFound, "not found: isu")
@@ -992,67 +1329,125 @@ func getIsuConditions(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	conditionsResponse, err := getIsuConditionsFromDB(db, jiaIsuUUID, endTime, conditionLevel, startTime, conditionLimit, isuName)
+	conditionsResponse, nextCursor, err := getIsuConditionsFromDB(db, jiaIsuUUID, endTime, conditionLevel, startTime, cursor, limit, isuName)
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	return c.JSON(http.StatusOK, conditionsResponse)
+
+	if !paginated {
+		return c.JSON(http.StatusOK, conditionsResponse)
+	}
+	res := GetIsuConditionPageResponse{Conditions: conditionsResponse}
+	if nextCursor != nil {
+		encoded := nextCursor.encode()
+		res.NextCursor = &encoded
+	}
+	return c.JSON(http.StatusOK, res)
 }
 
 // ISUのコンディションをDBから取得
+// limitより多くのコンディションがある場合は、次のページの位置も返す
 func getIsuConditionsFromDB(db *sqlx.DB, jiaIsuUUID string, endTime time.Time, conditionLevel map[string]interface{}, startTime time.Time,
-	limit int, isuName string) ([]*GetIsuConditionResponse, error) {
+	cursor *IsuConditionCursor, limit int, isuName string) ([]*GetIsuConditionResponse, *IsuConditionCursor, error) {
 
-	conditions := []IsuCondition{}
-	var err error
+	levels := []string{}
+	for _, level := range []string{conditionLevelInfo, conditionLevelWarning, conditionLevelCritical} {
+		if _, ok := conditionLevel[level]; ok {
+			levels = append(levels, level)
+		}
+	}
+	conditionsResponse := []*GetIsuConditionResponse{}
+	if len(levels) == 0 {
+		return conditionsResponse, nil, nil
+	}
 
-	if startTime.IsZero() {
-		err = db.Select(&conditions,
-			"SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ?"+
-				"	AND `timestamp` < ?"+
-				"	ORDER BY `timestamp` DESC",
-			jiaIsuUUID, endTime,
-		)
-	} else {
-		err = db.Select(&conditions,
-			"SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ?"+
-				"	AND `timestamp` < ?"+
-				"	AND ? <= `timestamp`"+
-				"	ORDER BY `timestamp` DESC",
-			jiaIsuUUID, endTime, startTime,
-		)
+	query := "SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ?" +
+		"	AND `timestamp` < ?" +
+		"	AND `condition_level` IN (?)"
+	args := []interface{}{jiaIsuUUID, endTime, levels}
+	if !startTime.IsZero() {
+		query += "	AND ? <= `timestamp`"
+		args = append(args, startTime)
+	}
+	if cursor != nil {
+		cursorTime := time.Unix(cursor.Timestamp, 0)
+		query += "	AND (`timestamp` < ? OR (`timestamp` = ? AND `id` < ?))"
+		args = append(args, cursorTime, cursorTime, cursor.ID)
 	}
+	query += "	ORDER BY `timestamp` DESC, `id` DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	query, args, err := sqlx.In(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	conditions := []IsuCondition{}
+	err = db.Select(&conditions, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("db error: %v", err)
+		return nil, nil, fmt.Errorf("db error: %v", err)
 	}
 
-	conditionsResponse := []*GetIsuConditionResponse{}
-	for _, c := range conditions {
-		cLevel, err := calculateConditionLevel(c.Condition)
-		if err != nil {
-			continue
-		}
-
-		if _, ok := conditionLevel[cLevel]; ok {
-			data := GetIsuConditionResponse{
-				JIAIsuUUID:     c.JIAIsuUUID,
-				IsuName:        isuName,
-				Timestamp:      c.Timestamp.Unix(),
-				IsSitting:      c.IsSitting,
-				Condition:      c.Condition,
-				ConditionLevel: cLevel,
-				Message:        c.Message,
+	// 保持期間を過ぎた時間は、集計に残した代表のコンディションを返す
+	archivedConditions, err := getArchivedIsuConditions(db, jiaIsuUUID, endTime, levels, startTime, cursor, limit+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(archivedConditions) > 0 {
+		conditions = append(conditions, archivedConditions...)
+		sort.Slice(conditions, func(i, j int) bool {
+			if !conditions[i].Timestamp.Equal(conditions[j].Timestamp) {
+				return conditions[i].Timestamp.After(conditions[j].Timestamp)
 			}
-			conditionsResponse = append(conditionsResponse, &data)
-		}
+			return conditions[i].ID > conditions[j].ID
+		})
+	}
+
+	var nextCursor *IsuConditionCursor
+	if len(conditions) > limit {
+		conditions = conditions[:limit]
+		last := conditions[len(conditions)-1]
+		nextCursor = &IsuConditionCursor{Timestamp: last.Timestamp.Unix(), ID: last.ID}
 	}
 
-	if len(conditionsResponse) > limit {
-		conditionsResponse = conditionsResponse[:limit]
+	for _, c := range conditions {
+		data := GetIsuConditionResponse{
+			JIAIsuUUID:     c.JIAIsuUUID,
+			IsuName:        isuName,
+			Timestamp:      c.Timestamp.Unix(),
+			IsSitting:      c.IsSitting,
+			Condition:      c.Condition,
+			ConditionLevel: c.ConditionLevel,
+			Message:        c.Message,
+		}
+		conditionsResponse = append(conditionsResponse, &data)
 	}
 
-	return conditionsResponse, nil
+	return conditionsResponse, nextCursor, nil
+}
+
+func (cursor *IsuConditionCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", cursor.Timestamp, cursor.ID)))
+}
+
+func decodeIsuConditionCursor(cursorStr string) (*IsuConditionCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursorStr)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(string(decoded), ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("bad format: cursor")
+	}
+	timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return &IsuConditionCursor{Timestamp: timestamp, ID: id}, nil
 }
 
 // ISUのコンディションの文字列からコンディションレベルを計算
@@ -1076,95 +1471,33 @@ func calculateConditionLevel(condition string) (string, error) {
 
 // GET /api/trend
 // ISUの性格毎の最新のコンディション情報
+// character, level, limit(レベルごとの件数), since で絞り込める
 func getTrend(c echo.Context) error {
-	characterList := []Isu{}
-	err := db.Select(&characterList, "SELECT `character` FROM `isu` GROUP BY `character`")
+	q, err := parseTrendQuery(c.QueryParam("character"), c.QueryParam("level"), c.QueryParam("limit"), c.QueryParam("since"))
 	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return c.String(http.StatusBadRequest, err.Error())
 	}
 
-	res := []TrendResponse{}
-
-	for _, character := range characterList {
-		isuList := []Isu{}
-		err = db.Select(&isuList,
-			"SELECT * FROM `isu` WHERE `character` = ?",
-			character.Character,
-		)
-		if err != nil {
-			c.Logger().Errorf("db error: %v", err)
-			return c.NoContent(http.StatusInternalServerError)
-		}
-
-		characterInfoIsuConditions := []*TrendCondition{}
-		characterWarningIsuConditions := []*TrendCondition{}
-		characterCriticalIsuConditions := []*TrendCondition{}
-		for _, isu := range isuList {
-			conditions := []IsuCondition{}
-			err = db.Select(&conditions,
-				"SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ? ORDER BY timestamp DESC",
-				isu.JIAIsuUUID,
-			)
-			if err != nil {
-				c.Logger().Errorf("db error: %v", err)
-				return c.NoContent(http.StatusInternalServerError)
-			}
-
-			if len(conditions) > 0 {
-				isuLastCondition := conditions[0]
-				conditionLevel, err := calculateConditionLevel(isuLastCondition.Condition)
-				if err != nil {
-					c.Logger().Error(err)
-					return c.NoContent(http.StatusInternalServerError)
-				}
-				trendCondition := TrendCondition{
-					ID:        isu.ID,
-					Timestamp: isuLastCondition.Timestamp.Unix(),
-				}
-				switch conditionLevel {
-				case "info":
-					characterInfoIsuConditions = append(characterInfoIsuConditions, &trendCondition)
-				case "warning":
-					characterWarningIsuConditions = append(characterWarningIsuConditions, &trendCondition)
-				case "critical":
-					characterCriticalIsuConditions = append(characterCriticalIsuConditions, &trendCondition)
-				}
-			}
-
-		}
+	body, etag, err := trendCache.Get(q)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
 
-		sort.Slice(characterInfoIsuConditions, func(i, j int) bool {
-			return characterInfoIsuConditions[i].Timestamp > characterInfoIsuConditions[j].Timestamp
-		})
-		sort.Slice(characterWarningIsuConditions, func(i, j int) bool {
-			return characterWarningIsuConditions[i].Timestamp > characterWarningIsuConditions[j].Timestamp
-		})
-		sort.Slice(characterCriticalIsuConditions, func(i, j int) bool {
-			return characterCriticalIsuConditions[i].Timestamp > characterCriticalIsuConditions[j].Timestamp
-		})
-		res = append(res,
-			TrendResponse{
-				Character: character.Character,
-				Info:      characterInfoIsuConditions,
-				Warning:   characterWarningIsuConditions,
-				Critical:  characterCriticalIsuConditions,
-			})
+	// 常に再検証させ、変わっていなければ304を返す
+	c.Response().Header().Set("ETag", etag)
+	c.Response().Header().Set("Cache-Control", "public, no-cache")
+	if matchETag(c.Request().Header.Get("If-None-Match"), etag) {
+		return c.NoContent(http.StatusNotModified)
 	}
 
-	return c.JSON(http.StatusOK, res)
+	return c.JSONBlob(http.StatusOK, body)
 }
 
 // POST /api/condition/:jia_isu_uuid
 // ISUからのコンディションを受け取る
+// 同じタイムスタンプのコンディションを再送しても一件として扱い、最初に受け取った内容を残す
 func postIsuCondition(c echo.Context) error {
-	// TODO: 一定割合リクエストを落としてしのぐようにしたが、本来は全量さばけるようにすべき
-	dropProbability := 0.9
-	if rand.Float64() <= dropProbability {
-		c.Logger().Warnf("drop post isu condition request")
-		return c.NoContent(http.StatusAccepted)
-	}
-
 	jiaIsuUUID := c.Param("jia_isu_uuid")
 	if jiaIsuUUID == "" {
 		return c.String(http.StatusBadRequest, "missing: jia_isu_uuid")
@@ -1178,51 +1511,73 @@ func postIsuCondition(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "bad request body")
 	}
 
-	tx, err := db.Beginx()
-	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	defer tx.Rollback()
-
 	var count int
-	err = tx.Get(&count, "SELECT COUNT(*) FROM `isu` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	err = db.Get(&count, "SELECT COUNT(*) FROM `isu` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 	if count == 0 {
+		conditionsRejected.Add(float64(len(req)), "not_found")
 		return c.String(http.StatusNotFound, "not found: isu")
 	}
 
+	conditions := make([]IsuCondition, 0, len(req))
 	for _, cond := range req {
-		timestamp := time.Unix(cond.Timestamp, 0)
-
-		if !isValidConditionFormat(cond.Condition) {
-			return c.String(http.StatusBadRequest, "bad request body")
-		}
-
-		_, err = tx.Exec(
-			"INSERT INTO `isu_condition`"+
-				"	(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`)"+
-				"	VALUES (?, ?, ?, ?, ?)",
-			jiaIsuUUID, timestamp, cond.IsSitting, cond.Condition, cond.Message)
+		condition, err := newIsuCondition(jiaIsuUUID, cond)
 		if err != nil {
-			c.Logger().Errorf("db error: %v", err)
-			return c.NoContent(http.StatusInternalServerError)
+			conditionsRejected.Add(float64(len(req)), "bad_request")
+			return c.String(http.StatusBadRequest, "bad request body")
 		}
-
+		conditions = append(conditions, condition)
 	}
 
-	err = tx.Commit()
+	err = conditionIngester.Enqueue(conditions)
 	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
+		if errors.Is(err, errConditionQueueFull) {
+			conditionsRejected.Add(float64(len(conditions)), "queue_full")
+			c.Logger().Warnf("condition queue is full: %v", jiaIsuUUID)
+			return c.NoContent(http.StatusServiceUnavailable)
+		}
+
+		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	conditionsAccepted.Add(float64(len(conditions)))
 
 	return c.NoContent(http.StatusAccepted)
 }
 
+// 受け取ったコンディションを検証し、各項目とコンディションレベルを解釈する。
+// DBに書き込めない値はここで弾き、書き込みのバッチ全体が失敗しないようにする
+func newIsuCondition(jiaIsuUUID string, req PostIsuConditionRequest) (IsuCondition, error) {
+	if !isValidConditionFormat(req.Condition) {
+		return IsuCondition{}, fmt.Errorf("invalid condition format")
+	}
+	if req.Timestamp < conditionMinTimestamp || conditionMaxTimestamp < req.Timestamp {
+		return IsuCondition{}, fmt.Errorf("bad format: timestamp")
+	}
+	if !utf8.ValidString(req.Message) || utf8.RuneCountInString(req.Message) > conditionMessageMaxLength {
+		return IsuCondition{}, fmt.Errorf("bad format: message")
+	}
+	conditionLevel, err := calculateConditionLevel(req.Condition)
+	if err != nil {
+		return IsuCondition{}, err
+	}
+
+	return IsuCondition{
+		JIAIsuUUID:     jiaIsuUUID,
+		Timestamp:      time.Unix(req.Timestamp, 0),
+		IsSitting:      req.IsSitting,
+		Condition:      req.Condition,
+		IsDirty:        strings.Contains(req.Condition, "is_dirty=true"),
+		IsOverweight:   strings.Contains(req.Condition, "is_overweight=true"),
+		IsBroken:       strings.Contains(req.Condition, "is_broken=true"),
+		ConditionLevel: conditionLevel,
+		Message:        req.Message,
+	}, nil
+}
+
 // ISUのコンディションの文字列がcsv形式になっているか検証
 func isValidConditionFormat(conditionStr string) bool {
 
@@ -1258,5 +1613,5 @@ func isValidConditionFormat(conditionStr string) bool {
 }
 
 func getIndex(c echo.Context) error {
-	return c.File(frontendContentsPath + "/index.html")
+	return c.File(serverConfig.Paths.FrontendContents + "/index.html")
 }
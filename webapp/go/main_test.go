@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestNewIsuCondition(t *testing.T) {
+	const validCondition = "is_dirty=true,is_overweight=false,is_broken=true"
+
+	tests := []struct {
+		name      string
+		req       PostIsuConditionRequest
+		wantErr   string
+		wantLevel string
+	}{
+		{
+			name:      "valid",
+			req:       PostIsuConditionRequest{IsSitting: true, Condition: validCondition, Message: "ok", Timestamp: 1627786800},
+			wantLevel: conditionLevelWarning,
+		},
+		{
+			name:      "all false",
+			req:       PostIsuConditionRequest{Condition: "is_dirty=false,is_overweight=false,is_broken=false", Timestamp: 1627786800},
+			wantLevel: conditionLevelInfo,
+		},
+		{
+			name:      "all true",
+			req:       PostIsuConditionRequest{Condition: "is_dirty=true,is_overweight=true,is_broken=true", Timestamp: 1627786800},
+			wantLevel: conditionLevelCritical,
+		},
+		{
+			name:    "keys out of order",
+			req:     PostIsuConditionRequest{Condition: "is_overweight=false,is_dirty=true,is_broken=true", Timestamp: 1627786800},
+			wantErr: "invalid condition format",
+		},
+		{
+			name:    "trailing comma",
+			req:     PostIsuConditionRequest{Condition: validCondition + ",", Timestamp: 1627786800},
+			wantErr: "invalid condition format",
+		},
+		{
+			name:    "empty condition",
+			req:     PostIsuConditionRequest{Timestamp: 1627786800},
+			wantErr: "invalid condition format",
+		},
+		{
+			name:    "timestamp before DATETIME range",
+			req:     PostIsuConditionRequest{Condition: validCondition, Timestamp: conditionMinTimestamp - 1},
+			wantErr: "bad format: timestamp",
+		},
+		{
+			name:    "timestamp after DATETIME range",
+			req:     PostIsuConditionRequest{Condition: validCondition, Timestamp: conditionMaxTimestamp + 1},
+			wantErr: "bad format: timestamp",
+		},
+		{
+			name:      "longest message",
+			req:       PostIsuConditionRequest{Condition: validCondition, Message: strings.Repeat("あ", conditionMessageMaxLength), Timestamp: 1627786800},
+			wantLevel: conditionLevelWarning,
+		},
+		{
+			name:    "message too long",
+			req:     PostIsuConditionRequest{Condition: validCondition, Message: strings.Repeat("a", conditionMessageMaxLength+1), Timestamp: 1627786800},
+			wantErr: "bad format: message",
+		},
+		{
+			name:    "message is not utf-8",
+			req:     PostIsuConditionRequest{Condition: validCondition, Message: "\xff", Timestamp: 1627786800},
+			wantErr: "bad format: message",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition, err := newIsuCondition("a", tt.req)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if condition.JIAIsuUUID != "a" || condition.Timestamp.Unix() != tt.req.Timestamp ||
+				condition.IsSitting != tt.req.IsSitting || condition.Message != tt.req.Message {
+				t.Errorf("got %+v for %+v", condition, tt.req)
+			}
+			if condition.ConditionLevel != tt.wantLevel {
+				t.Errorf("ConditionLevel = %q, want %q", condition.ConditionLevel, tt.wantLevel)
+			}
+			if condition.IsDirty != strings.Contains(tt.req.Condition, "is_dirty=true") ||
+				condition.IsOverweight != strings.Contains(tt.req.Condition, "is_overweight=true") ||
+				condition.IsBroken != strings.Contains(tt.req.Condition, "is_broken=true") {
+				t.Errorf("condition flags do not match %q: %+v", tt.req.Condition, condition)
+			}
+		})
+	}
+}
+
+func TestIsuConditionCursor(t *testing.T) {
+	for _, cursor := range []IsuConditionCursor{
+		{Timestamp: 1627786800, ID: 1},
+		{Timestamp: 1627786800, ID: 0}, // アーカイブした時間の代表のコンディション
+		{Timestamp: -1, ID: 42},
+	} {
+		decoded, err := decodeIsuConditionCursor(cursor.encode())
+		if err != nil {
+			t.Errorf("decode(encode(%+v)): %v", cursor, err)
+			continue
+		}
+		if *decoded != cursor {
+			t.Errorf("decode(encode(%+v)) = %+v", cursor, *decoded)
+		}
+	}
+
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	for _, bad := range []string{
+		"!!!",
+		encode("1627786800"),
+		encode("1627786800:1:2"),
+		encode("x:1"),
+		encode("1627786800:y"),
+		encode(""),
+	} {
+		if _, err := decodeIsuConditionCursor(bad); err == nil {
+			t.Errorf("decodeIsuConditionCursor(%q) succeeded, want an error", bad)
+		}
+	}
+}
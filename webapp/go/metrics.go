@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var defaultDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	httpRequestDuration = NewHistogramVec("isucondition_http_request_duration_seconds",
+		"Latency of HTTP requests by route.", defaultDurationBuckets, "method", "route", "code")
+	jiaRequestDuration = NewHistogramVec("isucondition_jia_request_duration_seconds",
+		"Latency of requests to JIAService.", defaultDurationBuckets, "endpoint", "code")
+
+	conditionsAccepted = NewCounterVec("isucondition_conditions_accepted_total",
+		"Conditions accepted from ISUs and queued for insertion.")
+	conditionsRejected = NewCounterVec("isucondition_conditions_rejected_total",
+		"Conditions rejected when posted by ISUs.", "reason")
+	conditionsInserted = NewCounterVec("isucondition_conditions_inserted_total",
+		"Conditions written to the database.")
+	conditionsDuplicated = NewCounterVec("isucondition_conditions_duplicated_total",
+		"Conditions dropped because a condition with the same timestamp already exists.")
+	conditionsDropped = NewCounterVec("isucondition_conditions_dropped_total",
+		"Conditions dropped because they could not be written to the database.")
+
+	metricsCollectors = []metricsCollector{
+		httpRequestDuration,
+		jiaRequestDuration,
+		conditionsAccepted,
+		conditionsRejected,
+		conditionsInserted,
+		conditionsDuplicated,
+		conditionsDropped,
+	}
+)
+
+type metricsCollector interface {
+	write(w io.Writer)
+}
+
+// ラベルごとに値を持つカウンタ
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	v := &CounterVec{name: name, help: help, labels: labels, values: map[string]*counterValue{}}
+	// ラベルの無いカウンタは、一度も増えていなくても0を出力する
+	if len(labels) == 0 {
+		v.values[""] = &counterValue{}
+	}
+	return v
+}
+
+func (v *CounterVec) Add(delta float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	value, ok := v.values[key]
+	if !ok {
+		value = &counterValue{labelValues: labelValues}
+		v.values[key] = value
+	}
+	value.value += delta
+}
+
+func (v *CounterVec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+func (v *CounterVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", v.name, v.help, v.name)
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := v.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatMetricLabels(v.labels, value.labelValues, ""), formatMetricValue(value.value))
+	}
+}
+
+// ラベルごとに値の分布を持つヒストグラム
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64 // バケットごとの、上限以下の値の数
+	sum         float64
+	count       uint64
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogramValue{}}
+}
+
+func (v *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	h, ok := v.values[key]
+	if !ok {
+		h = &histogramValue{labelValues: labelValues, counts: make([]uint64, len(v.buckets))}
+		v.values[key] = h
+	}
+	for i, upper := range v.buckets {
+		if value <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (v *HistogramVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", v.name, v.help, v.name)
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		h := v.values[key]
+		for i, upper := range v.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatMetricLabels(v.labels, h.labelValues, formatMetricValue(upper)), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatMetricLabels(v.labels, h.labelValues, "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, formatMetricLabels(v.labels, h.labelValues, ""), formatMetricValue(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, formatMetricLabels(v.labels, h.labelValues, ""), h.count)
+	}
+}
+
+// {name="value",...} の形式にする。leが空でなければヒストグラムのバケットの上限として加える
+func formatMetricLabels(names []string, values []string, le string) string {
+	pairs := []string{}
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, escapeMetricLabelValue(value)))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=%q", le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// %qでエスケープされない文字のみを残す
+func escapeMetricLabelValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return '?'
+		}
+		return r
+	}, value)
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func writeGauge(w io.Writer, name string, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatMetricValue(value))
+}
+
+func writeCounter(w io.Writer, name string, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %s\n", name, help, name, name, formatMetricValue(value))
+}
+
+// ルートごとのレイテンシを記録するミドルウェア
+func metricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		// エラーはこの後にエラーハンドラがレスポンスにするので、ステータスコードをエラーから求める
+		code := c.Response().Status
+		if err != nil {
+			code = http.StatusInternalServerError
+			if he, ok := err.(*echo.HTTPError); ok {
+				code = he.Code
+			}
+		}
+		// どのルートにも一致しないリクエストのパスはラベルにしない
+		route := c.Path()
+		if route == "" || (code == http.StatusNotFound && err != nil) {
+			route = "unmatched"
+		}
+		httpRequestDuration.Observe(time.Since(start).Seconds(), c.Request().Method, route, strconv.Itoa(code))
+		return err
+	}
+}
+
+// GET /metrics
+// Prometheusのテキスト形式でメトリクスを出力
+func getMetrics(c echo.Context) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	res.WriteHeader(http.StatusOK)
+
+	w := bufio.NewWriter(res)
+	for _, collector := range metricsCollectors {
+		collector.write(w)
+	}
+
+	writeGauge(w, "isucondition_condition_queue_length", "Conditions waiting to be inserted.",
+		float64(conditionIngester.Len()))
+
+	stats := db.Stats()
+	writeGauge(w, "isucondition_db_max_open_connections", "Maximum number of open connections to the database.",
+		float64(stats.MaxOpenConnections))
+	writeGauge(w, "isucondition_db_open_connections", "Number of established connections to the database.",
+		float64(stats.OpenConnections))
+	writeGauge(w, "isucondition_db_in_use_connections", "Number of connections currently in use.",
+		float64(stats.InUse))
+	writeGauge(w, "isucondition_db_idle_connections", "Number of idle connections.",
+		float64(stats.Idle))
+	writeCounter(w, "isucondition_db_wait_count_total", "Total number of connections waited for.",
+		float64(stats.WaitCount))
+	writeCounter(w, "isucondition_db_wait_duration_seconds_total", "Total time blocked waiting for a new connection.",
+		stats.WaitDuration.Seconds())
+
+	return w.Flush()
+}
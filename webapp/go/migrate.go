@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	migrationsPath     = "../sql/migrations"
+	baselineSchemaPath = "../sql/0_Schema.sql"
+	baselineDataPath   = "../sql/1_InitData.sql"
+
+	// 初期状態を複製しておくテーブルの接頭辞
+	snapshotTablePrefix = "_snapshot_"
+	snapshotMetaTable   = snapshotTablePrefix + "meta"
+)
+
+var migrationFileRegexp = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// SQLだけでは表せないデータの移行。
+// upはそのバージョンのSQLの後に、downはSQLの前に実行する
+var migrationFuncs = map[int]MigrationFunc{
+	5: {Up: moveIsuImagesToIconStore, Down: restoreIsuImagesFromIconStore},
+}
+
+type MigrationFunc struct {
+	Up   func(db *sqlx.DB) error
+	Down func(db *sqlx.DB) error
+}
+
+// バージョン付きのスキーマ変更
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	Func    MigrationFunc
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied bool
+}
+
+// migrationsディレクトリのSQLファイルを順に適用し、適用状況をschema_migrationsに記録する
+type Migrator struct {
+	db         *sqlx.DB
+	migrations []Migration
+}
+
+func NewMigrator(db *sqlx.DB, dir string) (*Migrator, error) {
+	migrations, err := loadMigrations(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// ディレクトリから {version}_{name}.up.sql と {version}_{name}.down.sql を読み込む
+func loadMigrations(dir string) ([]Migration, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %v", err)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, file := range files {
+		m := migrationFileRegexp.FindStringSubmatch(file.Name())
+		if m == nil {
+			continue
+		}
+		version, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, fmt.Errorf("bad format: migration version: %v", file.Name())
+		}
+		body, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration: %v", err)
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = migration
+		} else if migration.Name != m[2] {
+			return nil, fmt.Errorf("duplicated migration version: %v", version)
+		}
+		if m[3] == "up" {
+			migration.Up = string(body)
+		} else {
+			migration.Down = string(body)
+		}
+	}
+
+	migrations := []Migration{}
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("missing up migration: %d_%s", migration.Version, migration.Name)
+		}
+		migration.Func = migrationFuncs[migration.Version]
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+func (m *Migrator) ensureTable() error {
+	_, err := m.db.Exec(
+		"CREATE TABLE IF NOT EXISTS `schema_migrations` (" +
+			"	`version` BIGINT PRIMARY KEY," +
+			"	`name` VARCHAR(255) NOT NULL," +
+			"	`applied_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6)" +
+			") ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+func (m *Migrator) appliedVersions() (map[int]bool, error) {
+	err := m.ensureTable()
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []int{}
+	err = m.db.Select(&versions, "SELECT `version` FROM `schema_migrations`")
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	applied := map[int]bool{}
+	for _, version := range versions {
+		applied[version] = true
+	}
+	return applied, nil
+}
+
+// 各マイグレーションの適用状況を取得
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	applied, err := m.appliedVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []MigrationStatus{}
+	for _, migration := range m.migrations {
+		statuses = append(statuses, MigrationStatus{Migration: migration, Applied: applied[migration.Version]})
+	}
+	return statuses, nil
+}
+
+// 未適用のマイグレーションを古い順に全て適用する
+func (m *Migrator) Up() ([]Migration, error) {
+	applied, err := m.appliedVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	done := []Migration{}
+	for _, migration := range m.migrations {
+		if applied[migration.Version] {
+			continue
+		}
+		err = execSQL(m.db, strings.NewReader(migration.Up))
+		if err == nil && migration.Func.Up != nil {
+			err = migration.Func.Up(m.db)
+		}
+		if err != nil {
+			return done, fmt.Errorf("migration %d_%s: %v", migration.Version, migration.Name, err)
+		}
+		_, err = m.db.Exec("INSERT INTO `schema_migrations` (`version`, `name`) VALUES (?, ?)", migration.Version, migration.Name)
+		if err != nil {
+			return done, fmt.Errorf("db error: %v", err)
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// 適用済みのマイグレーションを新しい順にsteps個取り消す
+func (m *Migrator) Down(steps int) ([]Migration, error) {
+	applied, err := m.appliedVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	done := []Migration{}
+	for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		migration := m.migrations[i]
+		if !applied[migration.Version] {
+			continue
+		}
+		if migration.Down == "" {
+			return done, fmt.Errorf("missing down migration: %d_%s", migration.Version, migration.Name)
+		}
+		if migration.Func.Down != nil {
+			err = migration.Func.Down(m.db)
+		}
+		if err == nil {
+			err = execSQL(m.db, strings.NewReader(migration.Down))
+		}
+		if err != nil {
+			return done, fmt.Errorf("migration %d_%s: %v", migration.Version, migration.Name, err)
+		}
+		_, err = m.db.Exec("DELETE FROM `schema_migrations` WHERE `version` = ?", migration.Version)
+		if err != nil {
+			return done, fmt.Errorf("db error: %v", err)
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// ベンチマーク用の初期状態に戻す。
+// 初期データの読み込みとマイグレーションは時間がかかるので、一度作った初期状態をスナップショットのテーブルに複製しておき、
+// 初期データとマイグレーションが変わっていなければ次回からはスナップショットからMySQLの中で複製して戻す
+func (m *Migrator) Reset() error {
+	startedAt := time.Now()
+	fingerprint, err := m.baselineFingerprint()
+	if err != nil {
+		return err
+	}
+
+	ok, err := m.hasSnapshot(fingerprint)
+	if err != nil {
+		return err
+	}
+	if ok {
+		err = m.restoreSnapshot()
+		if err != nil {
+			return err
+		}
+		log.Infof("restored db from snapshot in %v", time.Since(startedAt))
+		return nil
+	}
+
+	err = m.resetFromBaseline()
+	if err != nil {
+		return err
+	}
+	err = m.takeSnapshot(fingerprint)
+	if err != nil {
+		return err
+	}
+	log.Infof("reset db from baseline and took snapshot in %v", time.Since(startedAt))
+	return nil
+}
+
+// 全てのテーブルを削除し、ベンチマーク用の初期データを読み込んでからマイグレーションを適用する
+func (m *Migrator) resetFromBaseline() error {
+	tables := []string{}
+	err := m.db.Select(&tables, "SHOW TABLES")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	for _, table := range tables {
+		_, err = m.db.Exec("DROP TABLE IF EXISTS `" + table + "`")
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+
+	for _, path := range []string{baselineSchemaPath, baselineDataPath} {
+		err = execSQLFile(m.db, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = m.Up()
+	if err != nil {
+		return err
+	}
+	return rebuildIsuConditionsHourly(m.db)
+}
+
+// 初期データとマイグレーションの内容を表す値。どちらかが変わるとスナップショットを作り直す
+func (m *Migrator) baselineFingerprint() (string, error) {
+	h := sha256.New()
+	for _, path := range []string{baselineSchemaPath, baselineDataPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to stat %v: %v", path, err)
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00%d\x00", path, info.Size(), info.ModTime().UnixNano())
+	}
+	for _, migration := range m.migrations {
+		fmt.Fprintf(h, "%d\x00%s\x00%s\x00", migration.Version, migration.Name, migration.Up)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// スナップショットのテーブル名を除いたテーブルと、スナップショットのテーブルを取得
+func (m *Migrator) listTables() ([]string, []string, error) {
+	tables := []string{}
+	err := m.db.Select(&tables, "SHOW TABLES")
+	if err != nil {
+		return nil, nil, fmt.Errorf("db error: %v", err)
+	}
+
+	live := []string{}
+	snapshots := []string{}
+	for _, table := range tables {
+		if table == snapshotMetaTable {
+			continue
+		}
+		if strings.HasPrefix(table, snapshotTablePrefix) {
+			snapshots = append(snapshots, strings.TrimPrefix(table, snapshotTablePrefix))
+		} else {
+			live = append(live, table)
+		}
+	}
+	return live, snapshots, nil
+}
+
+// 使えるスナップショットがあるか確認する。
+// アイコンはファイルに保存しているので、スナップショットのISUのアイコンが残っていることも確認する
+func (m *Migrator) hasSnapshot(fingerprint string) (bool, error) {
+	var metaCount int
+	err := m.db.Get(&metaCount,
+		"SELECT COUNT(*) FROM `information_schema`.`TABLES` WHERE `TABLE_SCHEMA` = DATABASE() AND `TABLE_NAME` = ?",
+		snapshotMetaTable)
+	if err != nil {
+		return false, fmt.Errorf("db error: %v", err)
+	}
+	if metaCount == 0 {
+		return false, nil
+	}
+
+	var saved string
+	err = m.db.Get(&saved, "SELECT `fingerprint` FROM `"+snapshotMetaTable+"`")
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("db error: %v", err)
+	}
+	if saved != fingerprint {
+		return false, nil
+	}
+
+	imageHashes := []string{}
+	err = m.db.Select(&imageHashes, "SELECT DISTINCT `image_hash` FROM `"+snapshotTablePrefix+"isu` WHERE `image_hash` <> ''")
+	if err != nil {
+		return false, fmt.Errorf("db error: %v", err)
+	}
+	for _, hash := range imageHashes {
+		if _, err := os.Stat(iconStore.path(hash)); err != nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// 現在の全てのテーブルをスナップショットのテーブルに複製する。
+// 途中で失敗したスナップショットを使わないよう、最後に内容を表す値を記録する
+func (m *Migrator) takeSnapshot(fingerprint string) error {
+	_, err := m.db.Exec("DROP TABLE IF EXISTS `" + snapshotMetaTable + "`")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	live, snapshots, err := m.listTables()
+	if err != nil {
+		return err
+	}
+	for _, table := range snapshots {
+		_, err = m.db.Exec("DROP TABLE `" + snapshotTablePrefix + table + "`")
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+	for _, table := range live {
+		err = copyTable(m.db, table, snapshotTablePrefix+table)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = m.db.Exec("CREATE TABLE `" + snapshotMetaTable + "` (`fingerprint` CHAR(64) NOT NULL) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	_, err = m.db.Exec("INSERT INTO `"+snapshotMetaTable+"` (`fingerprint`) VALUES (?)", fingerprint)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// 全てのテーブルを削除し、スナップショットのテーブルから複製する
+func (m *Migrator) restoreSnapshot() error {
+	live, snapshots, err := m.listTables()
+	if err != nil {
+		return err
+	}
+	for _, table := range live {
+		_, err = m.db.Exec("DROP TABLE `" + table + "`")
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+	for _, table := range snapshots {
+		err = copyTable(m.db, snapshotTablePrefix+table, table)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// テーブルの定義と内容をMySQLの中で複製する
+func copyTable(db *sqlx.DB, src string, dst string) error {
+	_, err := db.Exec("CREATE TABLE `" + dst + "` LIKE `" + src + "`")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	_, err = db.Exec("INSERT INTO `" + dst + "` SELECT * FROM `" + src + "`")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+func execSQLFile(db *sqlx.DB, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %v: %v", path, err)
+	}
+	defer f.Close()
+
+	err = execSQL(db, f)
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	return nil
+}
+
+// 行末の ; で区切られたSQLを一つのコネクションで順に実行する。
+// mysqldumpの出力は文字列中の改行をエスケープするので、そのまま読み込める
+func execSQL(db *sqlx.DB, r io.Reader) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(r)
+	var statement strings.Builder
+	for {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "--") {
+			statement.WriteString(line)
+			if strings.HasSuffix(trimmed, ";") {
+				err = execStatement(ctx, conn, statement.String())
+				if err != nil {
+					return err
+				}
+				statement.Reset()
+			}
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	if strings.TrimSpace(statement.String()) != "" {
+		return execStatement(ctx, conn, statement.String())
+	}
+	return nil
+}
+
+func execStatement(ctx context.Context, conn *sql.Conn, statement string) error {
+	_, err := conn.ExecContext(ctx, statement)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// isucondition migrate [up|down [steps]|status|reset]
+// スキーマのマイグレーションを実行するサブコマンド
+func runMigrateCommand(args []string) error {
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	config, err := LoadMigrateConfig(os.Getenv(configPathEnv))
+	if err != nil {
+		return err
+	}
+
+	conn, err := config.MySQL.ConnectDB()
+	if err != nil {
+		return fmt.Errorf("failed to connect db: %v", err)
+	}
+	defer conn.Close()
+
+	iconStore, err = NewIconStore(config.Paths.IconDir)
+	if err != nil {
+		return err
+	}
+
+	migrator, err := NewMigrator(conn, migrationsPath)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "up":
+		done, err := migrator.Up()
+		for _, migration := range done {
+			fmt.Printf("applied: %d_%s\n", migration.Version, migration.Name)
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("bad format: steps")
+			}
+		}
+		done, err := migrator.Down(steps)
+		for _, migration := range done {
+			fmt.Printf("reverted: %d_%s\n", migration.Version, migration.Name)
+		}
+		return err
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied"
+			}
+			fmt.Printf("%-8s %d_%s\n", state, status.Version, status.Name)
+		}
+		return nil
+	case "reset":
+		return migrator.Reset()
+	default:
+		return fmt.Errorf("unknown command: %v", command)
+	}
+}
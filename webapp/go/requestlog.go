@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	contextKeyRequestID = "request_id"
+	contextKeyJIAUserID = "jia_user_id"
+)
+
+// 受け取ったリクエストIDをそのまま使えるのは、ログに書いても安全な文字だけで構成されている場合のみ
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._\-]{1,128}$`)
+
+// アクセスログの一行
+type AccessLog struct {
+	Time       string  `json:"time"`
+	RequestID  string  `json:"request_id"`
+	RemoteIP   string  `json:"remote_ip"`
+	Method     string  `json:"method"`
+	URI        string  `json:"uri"`
+	Route      string  `json:"route"`
+	Status     int     `json:"status"`
+	LatencyMs  float64 `json:"latency_ms"`
+	BytesOut   int64   `json:"bytes_out"`
+	JIAUserID  string  `json:"jia_user_id,omitempty"`
+	JIAIsuUUID string  `json:"jia_isu_uuid,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// リクエストIDを決め、レスポンスヘッダとリクエスト中のログに付ける。
+// X-Request-IDヘッダを受け取った場合はその値を使う
+func requestIDMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		requestID := c.Request().Header.Get(echo.HeaderXRequestID)
+		if !requestIDRegexp.MatchString(requestID) {
+			var err error
+			requestID, err = newRequestID()
+			if err != nil {
+				return err
+			}
+		}
+
+		c.Set(contextKeyRequestID, requestID)
+		c.Response().Header().Set(echo.HeaderXRequestID, requestID)
+		c.SetLogger(&requestLogger{Logger: c.Echo().Logger, requestID: requestID})
+		return next(c)
+	}
+}
+
+func newRequestID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// リクエストのリクエストIDを取得
+func getRequestID(c echo.Context) string {
+	requestID, _ := c.Get(contextKeyRequestID).(string)
+	return requestID
+}
+
+// アクセスログをJSONで一行ずつ出力するミドルウェア
+func accessLogMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+		if err != nil {
+			// ステータスコードとバイト数を記録できるよう、先にエラーをレスポンスにする
+			c.Error(err)
+		}
+
+		req := c.Request()
+		res := c.Response()
+		entry := AccessLog{
+			Time:       start.Format(time.RFC3339Nano),
+			RequestID:  getRequestID(c),
+			RemoteIP:   c.RealIP(),
+			Method:     req.Method,
+			URI:        req.RequestURI,
+			Route:      c.Path(),
+			Status:     res.Status,
+			LatencyMs:  float64(time.Since(start).Microseconds()) / 1000,
+			BytesOut:   res.Size,
+			JIAIsuUUID: c.Param("jia_isu_uuid"),
+		}
+		entry.JIAUserID, _ = c.Get(contextKeyJIAUserID).(string)
+		if err != nil {
+			entry.Error = err.Error()
+		}
+
+		line, marshalErr := json.Marshal(entry)
+		if marshalErr == nil {
+			os.Stdout.Write(append(line, '\n'))
+		}
+		return nil
+	}
+}
+
+// 出力するログにリクエストIDを付けるロガー
+type requestLogger struct {
+	echo.Logger
+	requestID string
+}
+
+func (l *requestLogger) json(message string) log.JSON {
+	return log.JSON{"request_id": l.requestID, "message": message}
+}
+
+func (l *requestLogger) Print(i ...interface{}) {
+	l.Logger.Printj(l.json(fmt.Sprint(i...)))
+}
+
+func (l *requestLogger) Printf(format string, args ...interface{}) {
+	l.Logger.Printj(l.json(fmt.Sprintf(format, args...)))
+}
+
+func (l *requestLogger) Debug(i ...interface{}) {
+	l.Logger.Debugj(l.json(fmt.Sprint(i...)))
+}
+
+func (l *requestLogger) Debugf(format string, args ...interface{}) {
+	l.Logger.Debugj(l.json(fmt.Sprintf(format, args...)))
+}
+
+func (l *requestLogger) Info(i ...interface{}) {
+	l.Logger.Infoj(l.json(fmt.Sprint(i...)))
+}
+
+func (l *requestLogger) Infof(format string, args ...interface{}) {
+	l.Logger.Infoj(l.json(fmt.Sprintf(format, args...)))
+}
+
+func (l *requestLogger) Warn(i ...interface{}) {
+	l.Logger.Warnj(l.json(fmt.Sprint(i...)))
+}
+
+func (l *requestLogger) Warnf(format string, args ...interface{}) {
+	l.Logger.Warnj(l.json(fmt.Sprintf(format, args...)))
+}
+
+func (l *requestLogger) Error(i ...interface{}) {
+	l.Logger.Errorj(l.json(fmt.Sprint(i...)))
+}
+
+func (l *requestLogger) Errorf(format string, args ...interface{}) {
+	l.Logger.Errorj(l.json(fmt.Sprintf(format, args...)))
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	defaultConditionArchiveDir        = "../archive"
+	defaultConditionRetentionInterval = time.Hour
+	conditionArchiveWindow            = 24 * time.Hour
+	conditionArchiveDeleteBatchSize   = 1000
+)
+
+// アーカイブファイルの名前。最初のコンディションのタイムスタンプとID、最後のコンディションのID
+var archiveFileRegexp = regexp.MustCompile(`^(-?\d+)_(\d+)_(\d+)\.ndjson\.gz$`)
+
+// アーカイブファイルに書き出すコンディション
+type ArchivedIsuCondition struct {
+	ID             int    `json:"id"`
+	JIAIsuUUID     string `json:"jia_isu_uuid"`
+	Timestamp      int64  `json:"timestamp"`
+	IsSitting      bool   `json:"is_sitting"`
+	Condition      string `json:"condition"`
+	ConditionLevel string `json:"condition_level"`
+	Message        string `json:"message"`
+	CreatedAt      int64  `json:"created_at"`
+}
+
+// 一定期間より古いコンディションを圧縮したファイルに書き出し、isu_conditionから削除する。
+// 時間ごとの集計は残すので、グラフやコンディション一覧は集計から読み出せる
+type ConditionRetention struct {
+	age      time.Duration
+	interval time.Duration
+	dir      string
+}
+
+func NewConditionRetention(age time.Duration, interval time.Duration, dir string) (*ConditionRetention, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create archive dir: %v", err)
+	}
+	return &ConditionRetention{age: age, interval: interval, dir: dir}, nil
+}
+
+func (r *ConditionRetention) Run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := r.Archive(time.Now())
+		if err != nil {
+			log.Errorf("failed to archive isu conditions: %v", err)
+		}
+	}
+}
+
+// 保持期間を過ぎたコンディションを全てのISUについてアーカイブする
+func (r *ConditionRetention) Archive(now time.Time) error {
+	jiaIsuUUIDList := []string{}
+	err := db.Select(&jiaIsuUUIDList, "SELECT `jia_isu_uuid` FROM `isu`")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	cutoff := now.Add(-r.age).Truncate(time.Hour)
+	for _, jiaIsuUUID := range jiaIsuUUIDList {
+		latest, ok := latestConditionStore.Get(jiaIsuUUID)
+		if !ok {
+			continue
+		}
+		// 最新のコンディションを含む時間は残し、最新のコンディションをDBから読めるようにする
+		isuCutoff := cutoff
+		if latestHour := latest.Timestamp.Truncate(time.Hour); latestHour.Before(isuCutoff) {
+			isuCutoff = latestHour
+		}
+
+		err = r.archiveIsu(jiaIsuUUID, isuCutoff)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *ConditionRetention) archiveIsu(jiaIsuUUID string, cutoff time.Time) error {
+	for {
+		var oldest time.Time
+		err := db.Get(&oldest,
+			"SELECT `timestamp` FROM `isu_condition` WHERE `jia_isu_uuid` = ? AND `timestamp` < ? ORDER BY `timestamp` LIMIT 1",
+			jiaIsuUUID, cutoff)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			return fmt.Errorf("db error: %v", err)
+		}
+
+		// 一度に読み込む量を抑えるため、一定の期間ごとにアーカイブする
+		windowEnd := oldest.Truncate(time.Hour).Add(conditionArchiveWindow)
+		if windowEnd.After(cutoff) {
+			windowEnd = cutoff
+		}
+
+		conditions := []IsuCondition{}
+		err = db.Select(&conditions,
+			"SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ? AND `timestamp` < ? ORDER BY `timestamp`, `id`",
+			jiaIsuUUID, windowEnd)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		if len(conditions) == 0 {
+			return nil
+		}
+
+		err = r.writeArchive(jiaIsuUUID, conditions)
+		if err != nil {
+			return err
+		}
+		err = deleteArchivedIsuConditions(jiaIsuUUID, conditions)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// コンディションをgzip圧縮したNDJSONに書き出す。
+// ファイル名はコンディションのIDから決まるので、失敗して再実行した場合は同じファイルを上書きする
+func (r *ConditionRetention) writeArchive(jiaIsuUUID string, conditions []IsuCondition) error {
+	dir := filepath.Join(r.dir, jiaIsuUUID)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create archive dir: %v", err)
+	}
+
+	first, last := conditions[0], conditions[len(conditions)-1]
+	path := filepath.Join(dir, fmt.Sprintf("%d_%d_%d.ndjson.gz", first.Timestamp.Unix(), first.ID, last.ID))
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write archive: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	gz := gzip.NewWriter(tmp)
+	encoder := json.NewEncoder(gz)
+	for _, c := range conditions {
+		err = encoder.Encode(ArchivedIsuCondition{
+			ID:             c.ID,
+			JIAIsuUUID:     c.JIAIsuUUID,
+			Timestamp:      c.Timestamp.Unix(),
+			IsSitting:      c.IsSitting,
+			Condition:      c.Condition,
+			ConditionLevel: c.ConditionLevel,
+			Message:        c.Message,
+			CreatedAt:      c.CreatedAt.Unix(),
+		})
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to write archive: %v", err)
+		}
+	}
+	err = gz.Close()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write archive: %v", err)
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return fmt.Errorf("failed to write archive: %v", err)
+	}
+	return nil
+}
+
+// ISUのアーカイブファイル。ファイル内のコンディションはタイムスタンプとIDの順に並んでいる
+type isuConditionArchive struct {
+	path           string
+	firstTimestamp int64
+}
+
+// ISUのアーカイブファイルを、最初のコンディションのタイムスタンプの順に取得
+func listIsuConditionArchives(dir string, jiaIsuUUID string) ([]isuConditionArchive, error) {
+	files, err := ioutil.ReadDir(filepath.Join(dir, jiaIsuUUID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []isuConditionArchive{}, nil
+		}
+		return nil, fmt.Errorf("failed to read archive dir: %v", err)
+	}
+
+	archives := []isuConditionArchive{}
+	for _, file := range files {
+		m := archiveFileRegexp.FindStringSubmatch(file.Name())
+		if m == nil {
+			continue
+		}
+		firstTimestamp, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		archives = append(archives, isuConditionArchive{
+			path:           filepath.Join(dir, jiaIsuUUID, file.Name()),
+			firstTimestamp: firstTimestamp,
+		})
+	}
+	sort.Slice(archives, func(i, j int) bool { return archives[i].firstTimestamp < archives[j].firstTimestamp })
+	return archives, nil
+}
+
+// アーカイブファイルを開き、コンディションを一件ずつ読み出す関数を返す
+func openIsuConditionArchive(archive isuConditionArchive) (func() (ArchivedIsuCondition, bool, error), func() error, error) {
+	f, err := os.Open(archive.path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open archive: %v", err)
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("failed to read archive: %v: %v", archive.path, err)
+	}
+
+	decoder := json.NewDecoder(gz)
+	next := func() (ArchivedIsuCondition, bool, error) {
+		var condition ArchivedIsuCondition
+		err := decoder.Decode(&condition)
+		if err == io.EOF {
+			return condition, false, nil
+		}
+		if err != nil {
+			return condition, false, fmt.Errorf("failed to read archive: %v: %v", archive.path, err)
+		}
+		return condition, true, nil
+	}
+	closeFunc := func() error {
+		gz.Close()
+		return f.Close()
+	}
+	return next, closeFunc, nil
+}
+
+// アーカイブしたコンディションを削除し、時間ごとの集計に代表のコンディションを残す
+func deleteArchivedIsuConditions(jiaIsuUUID string, conditions []IsuCondition) error {
+	// 時間ごとの最新のコンディション
+	representatives := map[int64]IsuCondition{}
+	for _, condition := range conditions {
+		startAt := condition.Timestamp.Truncate(time.Hour).Unix()
+		if r, ok := representatives[startAt]; !ok || !condition.Timestamp.Before(r.Timestamp) {
+			representatives[startAt] = condition
+		}
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	for startAt, condition := range representatives {
+		_, err = tx.Exec("UPDATE `isu_condition_hourly` SET `archived` = 1 WHERE `jia_isu_uuid` = ? AND `start_at` = ?",
+			jiaIsuUUID, time.Unix(startAt, 0))
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		// 以前にアーカイブした代表より新しい場合のみ置き換える
+		_, err = tx.Exec("UPDATE `isu_condition_hourly` SET"+
+			"	`representative_timestamp` = ?, `representative_is_sitting` = ?, `representative_condition` = ?,"+
+			"	`representative_condition_level` = ?, `representative_message` = ?"+
+			"	WHERE `jia_isu_uuid` = ? AND `start_at` = ?"+
+			"	AND (`representative_timestamp` IS NULL OR `representative_timestamp` <= ?)",
+			condition.Timestamp, condition.IsSitting, condition.Condition,
+			condition.ConditionLevel, condition.Message,
+			jiaIsuUUID, time.Unix(startAt, 0),
+			condition.Timestamp)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+
+	for len(conditions) > 0 {
+		n := len(conditions)
+		if n > conditionArchiveDeleteBatchSize {
+			n = conditionArchiveDeleteBatchSize
+		}
+		ids := []int{}
+		for _, condition := range conditions[:n] {
+			ids = append(ids, condition.ID)
+		}
+		query, args, err := sqlx.In("DELETE FROM `isu_condition` WHERE `id` IN (?)", ids)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(query, args...)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		conditions = conditions[n:]
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// アーカイブした時間の代表のコンディションを新しい順に取得
+func getArchivedIsuConditions(db *sqlx.DB, jiaIsuUUID string, endTime time.Time, levels []string, startTime time.Time,
+	cursor *IsuConditionCursor, limit int) ([]IsuCondition, error) {
+
+	query := "SELECT * FROM `isu_condition_hourly` WHERE `jia_isu_uuid` = ? AND `archived` = 1" +
+		"	AND `representative_timestamp` < ?" +
+		"	AND `representative_condition_level` IN (?)"
+	args := []interface{}{jiaIsuUUID, endTime, levels}
+	if !startTime.IsZero() {
+		query += "	AND ? <= `representative_timestamp`"
+		args = append(args, startTime)
+	}
+	if cursor != nil {
+		// 代表のコンディションのIDは0なので、同じ時刻ならIDを持つコンディションより後に並ぶ
+		if cursor.ID > 0 {
+			query += "	AND `representative_timestamp` <= ?"
+		} else {
+			query += "	AND `representative_timestamp` < ?"
+		}
+		args = append(args, time.Unix(cursor.Timestamp, 0))
+	}
+	query += "	ORDER BY `start_at` DESC LIMIT ?"
+	args = append(args, limit)
+
+	query, args, err := sqlx.In(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	hourlyList := []IsuConditionHourly{}
+	err = db.Select(&hourlyList, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	conditions := []IsuCondition{}
+	for _, h := range hourlyList {
+		conditions = append(conditions, h.representativeCondition())
+	}
+	return conditions, nil
+}
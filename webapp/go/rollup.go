@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	rollupInsertBatchSize = 1000
+
+	graphResolutionTenMinutes = "10m"
+	graphResolutionHour       = "1h"
+	graphResolutionDay        = "1d"
+	graphMaxPoints            = 1000
+)
+
+// グラフの区間の幅
+var graphBucketSizes = map[string]time.Duration{
+	graphResolutionTenMinutes: 10 * time.Minute,
+	graphResolutionHour:       time.Hour,
+	graphResolutionDay:        24 * time.Hour,
+}
+
+// ISUのコンディションを1時間ごとに集計したもの
+type IsuConditionHourly struct {
+	JIAIsuUUID        string    `db:"jia_isu_uuid"`
+	StartAt           time.Time `db:"start_at"`
+	ConditionCount    int       `db:"condition_count"`
+	ScoreSum          int       `db:"score_sum"`
+	SittingCount      int       `db:"sitting_count"`
+	IsBrokenCount     int       `db:"is_broken_count"`
+	IsDirtyCount      int       `db:"is_dirty_count"`
+	IsOverweightCount int       `db:"is_overweight_count"`
+	Timestamps        string    `db:"timestamps"`
+
+	// 生のコンディションをアーカイブした時間は、その時間の最新のコンディションを代表として残す
+	Archived                     bool         `db:"archived"`
+	RepresentativeTimestamp      sql.NullTime `db:"representative_timestamp"`
+	RepresentativeIsSitting      bool         `db:"representative_is_sitting"`
+	RepresentativeCondition      string       `db:"representative_condition"`
+	RepresentativeConditionLevel string       `db:"representative_condition_level"`
+	RepresentativeMessage        string       `db:"representative_message"`
+}
+
+// 集計にコンディションを一件加える
+func (h *IsuConditionHourly) add(condition IsuCondition) error {
+	if condition.IsBroken {
+		h.IsBrokenCount++
+	}
+	if condition.IsDirty {
+		h.IsDirtyCount++
+	}
+	if condition.IsOverweight {
+		h.IsOverweightCount++
+	}
+
+	switch condition.ConditionLevel {
+	case conditionLevelInfo:
+		h.ScoreSum += scoreConditionLevelInfo
+	case conditionLevelWarning:
+		h.ScoreSum += scoreConditionLevelWarning
+	case conditionLevelCritical:
+		h.ScoreSum += scoreConditionLevelCritical
+	default:
+		return fmt.Errorf("unexpected condition level: %v", condition.ConditionLevel)
+	}
+
+	if condition.IsSitting {
+		h.SittingCount++
+	}
+	h.ConditionCount++
+
+	timestamp := strconv.FormatInt(condition.Timestamp.Unix(), 10)
+	if h.Timestamps == "" {
+		h.Timestamps = timestamp
+	} else {
+		h.Timestamps += "," + timestamp
+	}
+	return nil
+}
+
+// 別の集計を加える
+func (h *IsuConditionHourly) merge(other IsuConditionHourly) {
+	h.ConditionCount += other.ConditionCount
+	h.ScoreSum += other.ScoreSum
+	h.SittingCount += other.SittingCount
+	h.IsBrokenCount += other.IsBrokenCount
+	h.IsDirtyCount += other.IsDirtyCount
+	h.IsOverweightCount += other.IsOverweightCount
+	if h.Timestamps == "" {
+		h.Timestamps = other.Timestamps
+	} else if other.Timestamps != "" {
+		h.Timestamps += "," + other.Timestamps
+	}
+}
+
+// 集計からグラフの一つのデータ点を計算
+func (h *IsuConditionHourly) graphDataPoint() GraphDataPoint {
+	return GraphDataPoint{
+		Score: h.ScoreSum * 100 / 3 / h.ConditionCount,
+		Percentage: ConditionsPercentage{
+			Sitting:      h.SittingCount * 100 / h.ConditionCount,
+			IsBroken:     h.IsBrokenCount * 100 / h.ConditionCount,
+			IsOverweight: h.IsOverweightCount * 100 / h.ConditionCount,
+			IsDirty:      h.IsDirtyCount * 100 / h.ConditionCount,
+		},
+	}
+}
+
+// アーカイブした時間の代表のコンディションを取得。IDは0になる
+func (h *IsuConditionHourly) representativeCondition() IsuCondition {
+	return IsuCondition{
+		JIAIsuUUID:     h.JIAIsuUUID,
+		Timestamp:      h.RepresentativeTimestamp.Time,
+		IsSitting:      h.RepresentativeIsSitting,
+		Condition:      h.RepresentativeCondition,
+		ConditionLevel: h.RepresentativeConditionLevel,
+		Message:        h.RepresentativeMessage,
+	}
+}
+
+// 集計に含まれるコンディションのタイムスタンプを昇順で取得
+func (h *IsuConditionHourly) conditionTimestamps() ([]int64, error) {
+	timestamps := []int64{}
+	if h.Timestamps == "" {
+		return timestamps, nil
+	}
+	for _, s := range strings.Split(h.Timestamps, ",") {
+		timestamp, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad format: timestamps: %v", err)
+		}
+		timestamps = append(timestamps, timestamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps, nil
+}
+
+// コンディションをISUと時間ごとに集計する
+func aggregateIsuConditionsHourly(conditions []IsuCondition) ([]IsuConditionHourly, error) {
+	type hourlyKey struct {
+		jiaIsuUUID string
+		startAt    int64
+	}
+
+	index := map[hourlyKey]int{}
+	hourlyList := []IsuConditionHourly{}
+	for _, condition := range conditions {
+		startAt := condition.Timestamp.Truncate(time.Hour)
+		key := hourlyKey{condition.JIAIsuUUID, startAt.Unix()}
+
+		i, ok := index[key]
+		if !ok {
+			i = len(hourlyList)
+			index[key] = i
+			hourlyList = append(hourlyList, IsuConditionHourly{
+				JIAIsuUUID: condition.JIAIsuUUID,
+				StartAt:    startAt,
+			})
+		}
+
+		err := hourlyList[i].add(condition)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hourlyList, nil
+}
+
+// 1時間より短い区間ごとに、isu_conditionのコンディションを集計する。
+// アーカイブした時間はコンディションが残っていないので、時間ごとの集計をその時間の最初の区間に入れる
+func aggregateIsuConditionsByBucket(tx *sqlx.Tx, jiaIsuUUID string, startTime time.Time, endTime time.Time, bucketSize time.Duration) ([]*IsuConditionHourly, error) {
+	archivedList := []IsuConditionHourly{}
+	err := tx.Select(&archivedList,
+		"SELECT * FROM `isu_condition_hourly` WHERE `jia_isu_uuid` = ? AND `archived` = 1"+
+			"	AND ? <= `start_at` AND `start_at` < ?",
+		jiaIsuUUID, startTime, endTime,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	conditions := []IsuCondition{}
+	err = tx.Select(&conditions,
+		"SELECT `timestamp`, `is_sitting`, `is_dirty`, `is_overweight`, `is_broken`, `condition_level` FROM `isu_condition`"+
+			"	WHERE `jia_isu_uuid` = ? AND ? <= `timestamp` AND `timestamp` < ?"+
+			"	ORDER BY `timestamp` ASC",
+		jiaIsuUUID, startTime, endTime,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	return bucketIsuConditions(jiaIsuUUID, startTime, endTime, bucketSize, archivedList, conditions)
+}
+
+// 区間ごとにコンディションとアーカイブした時間の集計をまとめる。
+// 期間からはみ出すアーカイブした時間は、期間外のコンディションを含んでしまうので使わず、残っているコンディションだけを数える
+func bucketIsuConditions(jiaIsuUUID string, startTime time.Time, endTime time.Time, bucketSize time.Duration,
+	archivedList []IsuConditionHourly, conditions []IsuCondition) ([]*IsuConditionHourly, error) {
+
+	buckets := make([]*IsuConditionHourly, endTime.Sub(startTime)/bucketSize)
+	// 一部だけアーカイブした時間の残りのコンディションは、時間ごとの集計に含まれている
+	archivedHours := map[int64]struct{}{}
+	for _, hourly := range archivedList {
+		if hourly.StartAt.Before(startTime) || hourly.StartAt.Add(time.Hour).After(endTime) {
+			continue
+		}
+		archivedHours[hourly.StartAt.Unix()] = struct{}{}
+		i := hourly.StartAt.Sub(startTime) / bucketSize
+		if buckets[i] == nil {
+			buckets[i] = &IsuConditionHourly{JIAIsuUUID: jiaIsuUUID, StartAt: startTime.Add(i * bucketSize)}
+		}
+		buckets[i].merge(hourly)
+	}
+
+	for _, condition := range conditions {
+		if condition.Timestamp.Before(startTime) || !condition.Timestamp.Before(endTime) {
+			continue
+		}
+		if _, ok := archivedHours[condition.Timestamp.Truncate(time.Hour).Unix()]; ok {
+			continue
+		}
+		i := condition.Timestamp.Sub(startTime) / bucketSize
+		if buckets[i] == nil {
+			buckets[i] = &IsuConditionHourly{JIAIsuUUID: jiaIsuUUID, StartAt: startTime.Add(i * bucketSize)}
+		}
+		err := buckets[i].add(condition)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buckets, nil
+}
+
+// 1時間以上の区間ごとに、時間ごとの集計を束ねる
+func mergeIsuConditionsHourlyByBucket(tx *sqlx.Tx, jiaIsuUUID string, startTime time.Time, endTime time.Time, bucketSize time.Duration) ([]*IsuConditionHourly, error) {
+	hourlyList := []IsuConditionHourly{}
+	err := tx.Select(&hourlyList,
+		"SELECT * FROM `isu_condition_hourly` WHERE `jia_isu_uuid` = ?"+
+			"	AND ? <= `start_at` AND `start_at` < ?"+
+			"	ORDER BY `start_at` ASC",
+		jiaIsuUUID, startTime, endTime,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	buckets := make([]*IsuConditionHourly, endTime.Sub(startTime)/bucketSize)
+	for _, hourly := range hourlyList {
+		i := hourly.StartAt.Sub(startTime) / bucketSize
+		if buckets[i] == nil {
+			buckets[i] = &IsuConditionHourly{JIAIsuUUID: jiaIsuUUID, StartAt: startTime.Add(i * bucketSize)}
+		}
+		buckets[i].merge(hourly)
+	}
+	return buckets, nil
+}
+
+// 新たに書き込んだコンディションを時間ごとの集計に加算する
+func addIsuConditionsHourly(tx *sqlx.Tx, conditions []IsuCondition) error {
+	hourlyList, err := aggregateIsuConditionsHourly(conditions)
+	if err != nil {
+		return err
+	}
+
+	for len(hourlyList) > 0 {
+		n := len(hourlyList)
+		if n > rollupInsertBatchSize {
+			n = rollupInsertBatchSize
+		}
+
+		_, err = tx.NamedExec(
+			"INSERT INTO `isu_condition_hourly`"+
+				"	(`jia_isu_uuid`, `start_at`, `condition_count`, `score_sum`, `sitting_count`, `is_broken_count`, `is_dirty_count`, `is_overweight_count`, `timestamps`)"+
+				"	VALUES (:jia_isu_uuid, :start_at, :condition_count, :score_sum, :sitting_count, :is_broken_count, :is_dirty_count, :is_overweight_count, :timestamps)"+
+				"	ON DUPLICATE KEY UPDATE"+
+				"	`condition_count` = `condition_count` + VALUES(`condition_count`),"+
+				"	`score_sum` = `score_sum` + VALUES(`score_sum`),"+
+				"	`sitting_count` = `sitting_count` + VALUES(`sitting_count`),"+
+				"	`is_broken_count` = `is_broken_count` + VALUES(`is_broken_count`),"+
+				"	`is_dirty_count` = `is_dirty_count` + VALUES(`is_dirty_count`),"+
+				"	`is_overweight_count` = `is_overweight_count` + VALUES(`is_overweight_count`),"+
+				"	`timestamps` = CONCAT(`timestamps`, ',', VALUES(`timestamps`))",
+			hourlyList[:n])
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		hourlyList = hourlyList[n:]
+	}
+	return nil
+}
+
+// isu_conditionの内容から時間ごとの集計を作り直す。
+// コンディションをアプリケーションに読み込まず、MySQLの中で集計する
+func rebuildIsuConditionsHourly(db *sqlx.DB) error {
+	ctx := context.Background()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer conn.Close()
+
+	// timestampsは一時間分のタイムスタンプを全て連結するので、MEDIUMTEXTに収まる長さまで許す
+	_, err = conn.ExecContext(ctx, "SET SESSION `group_concat_max_len` = 16777215")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM `isu_condition_hourly`")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	_, err = tx.Exec("INSERT INTO `isu_condition_hourly`"+
+		"	(`jia_isu_uuid`, `start_at`, `condition_count`, `score_sum`, `sitting_count`, `is_broken_count`, `is_dirty_count`, `is_overweight_count`, `timestamps`)"+
+		"	SELECT `jia_isu_uuid`, DATE_FORMAT(`timestamp`, '%Y-%m-%d %H:00:00') AS `start_at`, COUNT(*),"+
+		"		SUM(CASE `condition_level` WHEN ? THEN ? WHEN ? THEN ? WHEN ? THEN ? END),"+
+		"		SUM(`is_sitting`), SUM(`is_broken`), SUM(`is_dirty`), SUM(`is_overweight`),"+
+		"		GROUP_CONCAT(TIMESTAMPDIFF(SECOND, ?, `timestamp`) ORDER BY `timestamp`, `id` SEPARATOR ',')"+
+		"	FROM `isu_condition` GROUP BY `jia_isu_uuid`, `start_at`",
+		conditionLevelInfo, scoreConditionLevelInfo,
+		conditionLevelWarning, scoreConditionLevelWarning,
+		conditionLevelCritical, scoreConditionLevelCritical,
+		// DATETIMEはAsia/Tokyoの時刻で書き込んでいるので、その時刻でのUNIXエポックからの秒数にする
+		time.Unix(0, 0),
+	)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
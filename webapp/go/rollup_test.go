@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketIsuConditions(t *testing.T) {
+	base := time.Date(2021, 8, 1, 10, 0, 0, 0, time.Local)
+	condition := func(offset time.Duration, level string) IsuCondition {
+		return IsuCondition{JIAIsuUUID: "a", Timestamp: base.Add(offset), ConditionLevel: level}
+	}
+	archived := func(offset time.Duration, count int) IsuConditionHourly {
+		return IsuConditionHourly{
+			JIAIsuUUID:     "a",
+			StartAt:        base.Add(offset),
+			ConditionCount: count,
+			ScoreSum:       count * scoreConditionLevelInfo,
+			Archived:       true,
+		}
+	}
+
+	tests := []struct {
+		name       string
+		start      time.Duration
+		end        time.Duration
+		archived   []IsuConditionHourly
+		conditions []IsuCondition
+		want       map[int]int // 区間の番号とコンディションの数。含まれない区間は空
+		wantLen    int
+	}{
+		{
+			name:       "live conditions",
+			start:      0,
+			end:        time.Hour,
+			conditions: []IsuCondition{condition(0, conditionLevelInfo), condition(9*time.Minute, conditionLevelInfo), condition(10*time.Minute, conditionLevelWarning), condition(59*time.Minute, conditionLevelCritical)},
+			want:       map[int]int{0: 2, 1: 1, 5: 1},
+			wantLen:    6,
+		},
+		{
+			name:     "archived hour goes to its first bucket",
+			start:    0,
+			end:      2 * time.Hour,
+			archived: []IsuConditionHourly{archived(time.Hour, 5)},
+			want:     map[int]int{6: 5},
+			wantLen:  12,
+		},
+		{
+			// 一部だけアーカイブした時間の残りのコンディションは集計に含まれているので数えない
+			name:       "live conditions in an archived hour",
+			start:      0,
+			end:        time.Hour,
+			archived:   []IsuConditionHourly{archived(0, 3)},
+			conditions: []IsuCondition{condition(30*time.Minute, conditionLevelInfo)},
+			want:       map[int]int{0: 3},
+			wantLen:    6,
+		},
+		{
+			// 期間の前から始まるアーカイブした時間は、期間外のコンディションを含むので使わない
+			name:       "archived hour starting before the range",
+			start:      30 * time.Minute,
+			end:        2 * time.Hour,
+			archived:   []IsuConditionHourly{archived(0, 4), archived(time.Hour, 2)},
+			conditions: []IsuCondition{condition(40*time.Minute, conditionLevelInfo)},
+			want:       map[int]int{1: 1, 3: 2},
+			wantLen:    9,
+		},
+		{
+			name:       "archived hour ending after the range",
+			start:      0,
+			end:        90 * time.Minute,
+			archived:   []IsuConditionHourly{archived(time.Hour, 4)},
+			conditions: []IsuCondition{condition(70*time.Minute, conditionLevelInfo)},
+			want:       map[int]int{7: 1},
+			wantLen:    9,
+		},
+		{
+			name:       "conditions outside the range",
+			start:      0,
+			end:        time.Hour,
+			conditions: []IsuCondition{condition(-time.Second, conditionLevelInfo), condition(time.Hour, conditionLevelInfo)},
+			want:       map[int]int{},
+			wantLen:    6,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			startTime := base.Add(tt.start)
+			buckets, err := bucketIsuConditions("a", startTime, base.Add(tt.end), 10*time.Minute, tt.archived, tt.conditions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(buckets) != tt.wantLen {
+				t.Fatalf("got %d buckets, want %d", len(buckets), tt.wantLen)
+			}
+			for i, bucket := range buckets {
+				want, ok := tt.want[i]
+				if !ok {
+					if bucket != nil {
+						t.Errorf("bucket %d has %d conditions, want empty", i, bucket.ConditionCount)
+					}
+					continue
+				}
+				if bucket == nil {
+					t.Errorf("bucket %d is empty, want %d conditions", i, want)
+					continue
+				}
+				if bucket.ConditionCount != want {
+					t.Errorf("bucket %d has %d conditions, want %d", i, bucket.ConditionCount, want)
+				}
+				if wantStart := startTime.Add(time.Duration(i) * 10 * time.Minute); !bucket.StartAt.Equal(wantStart) {
+					t.Errorf("bucket %d starts at %v, want %v", i, bucket.StartAt, wantStart)
+				}
+			}
+		})
+	}
+}
+
+func TestIsuConditionHourlyGraphDataPoint(t *testing.T) {
+	hourlyList, err := aggregateIsuConditionsHourly([]IsuCondition{
+		{JIAIsuUUID: "a", Timestamp: time.Unix(3600, 0), IsSitting: true, IsDirty: true, ConditionLevel: conditionLevelWarning},
+		{JIAIsuUUID: "a", Timestamp: time.Unix(3601, 0), ConditionLevel: conditionLevelInfo},
+		{JIAIsuUUID: "a", Timestamp: time.Unix(7200, 0), IsBroken: true, ConditionLevel: conditionLevelCritical},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hourlyList) != 2 {
+		t.Fatalf("got %d hours, want 2", len(hourlyList))
+	}
+
+	merged := hourlyList[0]
+	merged.merge(hourlyList[1])
+	got := merged.graphDataPoint()
+	want := GraphDataPoint{
+		Score:      (scoreConditionLevelWarning + scoreConditionLevelInfo + scoreConditionLevelCritical) * 100 / 3 / 3,
+		Percentage: ConditionsPercentage{Sitting: 33, IsBroken: 33, IsDirty: 33},
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	timestamps, err := merged.conditionTimestamps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timestamps) != 3 || timestamps[0] != 3600 || timestamps[2] != 7200 {
+		t.Errorf("got timestamps %v", timestamps)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"container/list"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	sessionLifetime          = 24 * time.Hour
+	sessionPurgeInterval     = 10 * time.Minute
+	defaultSessionCacheSize  = 100000
+	sessionIDBytes           = 32
+	sessionBackendMySQL      = "mysql"
+	sessionBackendMemory     = "memory"
+	sessionValueKeySessionID = "session_id"
+)
+
+// サーバー側で保持するログインセッション
+type UserSession struct {
+	ID        string    `db:"id"`
+	JIAUserID string    `db:"jia_user_id"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// ログインセッションの保存先
+type SessionBackend interface {
+	// セッションを保存する
+	Create(session UserSession) error
+	// セッションを取得する。存在しない場合はokがfalseになる
+	Get(id string) (session UserSession, ok bool, err error)
+	// セッションを削除する
+	Delete(id string) error
+	// ユーザーの全てのセッションを削除する
+	DeleteUser(jiaUserID string) error
+	// 期限切れのセッションを削除する
+	DeleteExpired(now time.Time) error
+	// 全てのセッションを削除する
+	Reset() error
+}
+
+// session.backendに応じたセッションの保存先を作成
+func NewSessionBackend(backend string, cacheSize int, db *sqlx.DB) (SessionBackend, error) {
+	switch backend {
+	case sessionBackendMySQL:
+		return NewMySQLSessionBackend(db), nil
+	case sessionBackendMemory:
+		return NewMemorySessionBackend(cacheSize), nil
+	default:
+		return nil, fmt.Errorf("unknown session backend: %v", backend)
+	}
+}
+
+// user_sessionテーブルにセッションを保存する
+type MySQLSessionBackend struct {
+	db *sqlx.DB
+}
+
+func NewMySQLSessionBackend(db *sqlx.DB) *MySQLSessionBackend {
+	return &MySQLSessionBackend{db: db}
+}
+
+func (b *MySQLSessionBackend) Create(session UserSession) error {
+	_, err := b.db.NamedExec(
+		"INSERT INTO `user_session` (`id`, `jia_user_id`, `expires_at`) VALUES (:id, :jia_user_id, :expires_at)",
+		session)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+func (b *MySQLSessionBackend) Get(id string) (UserSession, bool, error) {
+	var session UserSession
+	err := b.db.Get(&session, "SELECT `id`, `jia_user_id`, `expires_at` FROM `user_session` WHERE `id` = ?", id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UserSession{}, false, nil
+		}
+		return UserSession{}, false, fmt.Errorf("db error: %v", err)
+	}
+	return session, true, nil
+}
+
+func (b *MySQLSessionBackend) Delete(id string) error {
+	_, err := b.db.Exec("DELETE FROM `user_session` WHERE `id` = ?", id)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+func (b *MySQLSessionBackend) DeleteUser(jiaUserID string) error {
+	_, err := b.db.Exec("DELETE FROM `user_session` WHERE `jia_user_id` = ?", jiaUserID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+func (b *MySQLSessionBackend) DeleteExpired(now time.Time) error {
+	_, err := b.db.Exec("DELETE FROM `user_session` WHERE `expires_at` < ?", now)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// テーブルは初期化時に作り直されるので何もしない
+func (b *MySQLSessionBackend) Reset() error {
+	return nil
+}
+
+// メモリ上にセッションを保存する。上限を超えると最も長く使われていないセッションを破棄する
+type MemorySessionBackend struct {
+	mu       sync.Mutex
+	capacity int
+	lru      *list.List // 先頭ほど最近使われたセッション
+	sessions map[string]*list.Element
+}
+
+func NewMemorySessionBackend(capacity int) *MemorySessionBackend {
+	return &MemorySessionBackend{
+		capacity: capacity,
+		lru:      list.New(),
+		sessions: map[string]*list.Element{},
+	}
+}
+
+func (b *MemorySessionBackend) Create(session UserSession) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if elem, ok := b.sessions[session.ID]; ok {
+		elem.Value = session
+		b.lru.MoveToFront(elem)
+		return nil
+	}
+
+	b.sessions[session.ID] = b.lru.PushFront(session)
+	for b.lru.Len() > b.capacity {
+		b.remove(b.lru.Back())
+	}
+	return nil
+}
+
+func (b *MemorySessionBackend) Get(id string) (UserSession, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	elem, ok := b.sessions[id]
+	if !ok {
+		return UserSession{}, false, nil
+	}
+	b.lru.MoveToFront(elem)
+	return elem.Value.(UserSession), true, nil
+}
+
+func (b *MemorySessionBackend) Delete(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if elem, ok := b.sessions[id]; ok {
+		b.remove(elem)
+	}
+	return nil
+}
+
+func (b *MemorySessionBackend) DeleteUser(jiaUserID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for elem := b.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(UserSession).JIAUserID == jiaUserID {
+			b.remove(elem)
+		}
+		elem = next
+	}
+	return nil
+}
+
+func (b *MemorySessionBackend) DeleteExpired(now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for elem := b.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(UserSession).ExpiresAt.Before(now) {
+			b.remove(elem)
+		}
+		elem = next
+	}
+	return nil
+}
+
+func (b *MemorySessionBackend) Reset() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lru.Init()
+	b.sessions = map[string]*list.Element{}
+	return nil
+}
+
+func (b *MemorySessionBackend) remove(elem *list.Element) {
+	b.lru.Remove(elem)
+	delete(b.sessions, elem.Value.(UserSession).ID)
+}
+
+// 期限切れのセッションを定期的に削除する
+func purgeExpiredSessions() {
+	ticker := time.NewTicker(sessionPurgeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := sessionBackend.DeleteExpired(time.Now())
+		if err != nil {
+			log.Errorf("failed to purge sessions: %v", err)
+		}
+	}
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, sessionIDBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate session id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ユーザーの新しいセッションを作成し、セッションIDをCookieに書き込む
+func startSession(c echo.Context, jiaUserID string) error {
+	session, err := getSession(c.Request())
+	if err != nil {
+		return err
+	}
+
+	// 以前のセッションが残っていれば破棄する
+	if id, ok := session.Values[sessionValueKeySessionID].(string); ok {
+		err = sessionBackend.Delete(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		return err
+	}
+	err = sessionBackend.Create(UserSession{
+		ID:        id,
+		JIAUserID: jiaUserID,
+		ExpiresAt: time.Now().Add(sessionLifetime),
+	})
+	if err != nil {
+		return err
+	}
+
+	session.Values = map[interface{}]interface{}{sessionValueKeySessionID: id}
+	session.Options = &sessions.Options{MaxAge: int(sessionLifetime / time.Second), Path: "/", HttpOnly: true}
+	return session.Save(c.Request(), c.Response())
+}
+
+// Cookieのセッションを破棄する
+func endSession(c echo.Context) error {
+	session, err := getSession(c.Request())
+	if err != nil {
+		return err
+	}
+
+	if id, ok := session.Values[sessionValueKeySessionID].(string); ok {
+		err = sessionBackend.Delete(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	session.Options = &sessions.Options{MaxAge: -1, Path: "/"}
+	return session.Save(c.Request(), c.Response())
+}
+
+// POST /api/signout/all
+// 全ての端末からサインアウト
+func postSignoutAll(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = sessionBackend.DeleteUser(jiaUserID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = endSession(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	streamSubscriberBufferSize = 256
+	streamKeepAliveInterval    = 30 * time.Second
+)
+
+// 書き込まれたコンディションを購読者へ配信する
+type ConditionHub struct {
+	mu          sync.Mutex
+	subscribers map[*ConditionSubscriber]struct{}
+}
+
+// コンディションの購読者
+type ConditionSubscriber struct {
+	jiaUserID      string
+	isuNames       map[string]string // 購読対象のISUのUUIDと名前
+	conditionLevel map[string]interface{}
+	ch             chan *GetIsuConditionResponse
+
+	// 購読対象が決まるまでの間に利用できなくなったISU
+	started bool
+	revoked map[string]struct{}
+}
+
+func NewConditionHub() *ConditionHub {
+	return &ConditionHub{
+		subscribers: map[*ConditionSubscriber]struct{}{},
+	}
+}
+
+// ユーザーの購読を登録する。Startで購読対象を指定するまでは何も配信しない。
+// 購読対象を確認するより前に登録しておくことで、確認している間の権限の取り消しも反映する
+func (h *ConditionHub) Subscribe(jiaUserID string, conditionLevel map[string]interface{}) *ConditionSubscriber {
+	s := &ConditionSubscriber{
+		jiaUserID:      jiaUserID,
+		isuNames:       map[string]string{},
+		conditionLevel: conditionLevel,
+		ch:             make(chan *GetIsuConditionResponse, streamSubscriberBufferSize),
+		revoked:        map[string]struct{}{},
+	}
+
+	h.mu.Lock()
+	h.subscribers[s] = struct{}{}
+	h.mu.Unlock()
+	return s
+}
+
+// 購読対象のISUを指定して配信を開始する
+func (h *ConditionHub) Start(s *ConditionSubscriber, isuNames map[string]string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[s]; !ok {
+		return
+	}
+	for jiaIsuUUID, isuName := range isuNames {
+		if _, ok := s.revoked[jiaIsuUUID]; !ok {
+			s.isuNames[jiaIsuUUID] = isuName
+		}
+	}
+	s.started = true
+	s.revoked = nil
+	if len(isuNames) > 0 && len(s.isuNames) == 0 {
+		delete(h.subscribers, s)
+		close(s.ch)
+	}
+}
+
+// 削除されたISUを全ての購読から外す
+func (h *ConditionHub) RevokeIsu(jiaIsuUUID string) {
+	h.revoke(jiaIsuUUID, func(s *ConditionSubscriber) bool { return true })
+}
+
+// ユーザーが利用できなくなったISUを、そのユーザーの購読から外す
+func (h *ConditionHub) RevokeAccess(jiaIsuUUID string, jiaUserID string) {
+	h.revoke(jiaIsuUUID, func(s *ConditionSubscriber) bool { return s.jiaUserID == jiaUserID })
+}
+
+// 購読対象のISUが全て外れた購読は打ち切る
+func (h *ConditionHub) revoke(jiaIsuUUID string, match func(s *ConditionSubscriber) bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for s := range h.subscribers {
+		if !match(s) {
+			continue
+		}
+		if !s.started {
+			s.revoked[jiaIsuUUID] = struct{}{}
+			continue
+		}
+		if _, ok := s.isuNames[jiaIsuUUID]; !ok {
+			continue
+		}
+		delete(s.isuNames, jiaIsuUUID)
+		if len(s.isuNames) == 0 {
+			delete(h.subscribers, s)
+			close(s.ch)
+		}
+	}
+}
+
+// 購読しているISUの名前を変更する
+func (h *ConditionHub) Rename(jiaIsuUUID string, isuName string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for s := range h.subscribers {
+		if _, ok := s.isuNames[jiaIsuUUID]; ok {
+			s.isuNames[jiaIsuUUID] = isuName
+		}
+	}
+}
+
+// 購読を解除する
+func (h *ConditionHub) Unsubscribe(s *ConditionSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[s]; ok {
+		delete(h.subscribers, s)
+		close(s.ch)
+	}
+}
+
+// コンディションを購読者に配信する。
+// 受信が追いつかない購読者は購読を打ち切り、再接続させる
+func (h *ConditionHub) Publish(conditions []IsuCondition) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for s := range h.subscribers {
+		for _, condition := range conditions {
+			isuName, ok := s.isuNames[condition.JIAIsuUUID]
+			if !ok {
+				continue
+			}
+			if _, ok := s.conditionLevel[condition.ConditionLevel]; !ok {
+				continue
+			}
+
+			data := &GetIsuConditionResponse{
+				JIAIsuUUID:     condition.JIAIsuUUID,
+				IsuName:        isuName,
+				Timestamp:      condition.Timestamp.Unix(),
+				IsSitting:      condition.IsSitting,
+				Condition:      condition.Condition,
+				ConditionLevel: condition.ConditionLevel,
+				Message:        condition.Message,
+			}
+			select {
+			case s.ch <- data:
+			default:
+				delete(h.subscribers, s)
+				close(s.ch)
+			}
+			if _, ok := h.subscribers[s]; !ok {
+				break
+			}
+		}
+	}
+}
+
+// condition_levelクエリパラメータを解釈する。省略時は全てのレベルを対象とする
+func parseConditionLevelQuery(conditionLevelCSV string) map[string]interface{} {
+	conditionLevel := map[string]interface{}{}
+	if conditionLevelCSV == "" {
+		conditionLevelCSV = strings.Join([]string{conditionLevelInfo, conditionLevelWarning, conditionLevelCritical}, ",")
+	}
+	for _, level := range strings.Split(conditionLevelCSV, ",") {
+		conditionLevel[level] = struct{}{}
+	}
+	return conditionLevel
+}
+
+// GET /api/isu/:jia_isu_uuid/stream
+// ISUのコンディションをServer-Sent Eventsで配信
+func getIsuConditionStream(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	conditionLevel := parseConditionLevelQuery(c.QueryParam("condition_level"))
+
+	subscriber := conditionHub.Subscribe(jiaUserID, conditionLevel)
+	defer conditionHub.Unsubscribe(subscriber)
+
+	_, errStatusCode, err = authorizeIsu(db, jiaUserID, jiaIsuUUID, isuRoleViewer)
+	if err != nil {
+		if errStatusCode == http.StatusNotFound {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, "forbidden")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var isuName string
+	err = db.Get(&isuName, "SELECT name FROM `isu` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	conditionHub.Start(subscriber, map[string]string{jiaIsuUUID: isuName})
+	return streamIsuConditions(c, subscriber)
+}
+
+// GET /api/isu/stream
+// 自分の全てのISUのコンディションをServer-Sent Eventsで配信
+// 接続後に登録したISUは配信対象に含まれない。削除や権限の取り消しで利用できなくなったISUは配信対象から外す
+func getIsuListConditionStream(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	conditionLevel := parseConditionLevelQuery(c.QueryParam("condition_level"))
+
+	subscriber := conditionHub.Subscribe(jiaUserID, conditionLevel)
+	defer conditionHub.Unsubscribe(subscriber)
+
+	isuList := []Isu{}
+	err = db.Select(&isuList,
+		"SELECT `isu`.`jia_isu_uuid`, `isu`.`name` FROM `isu` JOIN `isu_access` ON `isu`.`jia_isu_uuid` = `isu_access`.`jia_isu_uuid`"+
+			"	WHERE `isu_access`.`jia_user_id` = ?",
+		jiaUserID,
+	)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	isuNames := map[string]string{}
+	for _, isu := range isuList {
+		isuNames[isu.JIAIsuUUID] = isu.Name
+	}
+
+	conditionHub.Start(subscriber, isuNames)
+	return streamIsuConditions(c, subscriber)
+}
+
+func streamIsuConditions(c echo.Context, subscriber *ConditionSubscriber) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	ticker := time.NewTicker(streamKeepAliveInterval)
+	defer ticker.Stop()
+
+	ctx := c.Request().Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			_, err := fmt.Fprint(res, ": keepalive\n\n")
+			if err != nil {
+				return nil
+			}
+			res.Flush()
+		case condition, ok := <-subscriber.ch:
+			if !ok {
+				return nil
+			}
+			data, err := json.Marshal(condition)
+			if err != nil {
+				c.Logger().Error(err)
+				return nil
+			}
+			_, err = fmt.Fprintf(res, "data: %s\n\n", data)
+			if err != nil {
+				return nil
+			}
+			res.Flush()
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTrendCacheTTL = time.Second
+	trendCacheMaxEntries = 1000
+)
+
+// GET /api/trend の絞り込み条件
+type TrendQuery struct {
+	Character string
+	Levels    map[string]interface{}
+	Limit     int   // 0の場合は全て
+	Since     int64 // 0の場合は全て
+}
+
+// クエリパラメータから絞り込み条件を読み込む
+func parseTrendQuery(character string, level string, limit string, since string) (TrendQuery, error) {
+	q := TrendQuery{Character: character}
+
+	q.Levels = parseConditionLevelQuery(level)
+	for l := range q.Levels {
+		if l != conditionLevelInfo && l != conditionLevelWarning && l != conditionLevelCritical {
+			return q, fmt.Errorf("bad format: level")
+		}
+	}
+
+	if limit != "" {
+		limitInt, err := strconv.Atoi(limit)
+		if err != nil || limitInt <= 0 {
+			return q, fmt.Errorf("bad format: limit")
+		}
+		q.Limit = limitInt
+	}
+
+	if since != "" {
+		sinceInt64, err := strconv.ParseInt(since, 10, 64)
+		if err != nil {
+			return q, fmt.Errorf("bad format: since")
+		}
+		q.Since = sinceInt64
+	}
+	return q, nil
+}
+
+// キャッシュのキー。同じ条件であれば同じキーになる
+func (q TrendQuery) key() string {
+	levels := []string{}
+	for level := range q.Levels {
+		levels = append(levels, level)
+	}
+	sort.Strings(levels)
+	return fmt.Sprintf("%s\x00%s\x00%d\x00%d", q.Character, strings.Join(levels, ","), q.Limit, q.Since)
+}
+
+// 絞り込み条件に従ってレスポンスを生成する
+func generateTrendResponse(q TrendQuery) ([]TrendResponse, error) {
+	// activateが終わっていないISUは性格が決まっていないので含めない
+	query := "SELECT `id`, `jia_isu_uuid`, `character` FROM `isu` WHERE `character` <> ''"
+	args := []interface{}{}
+	if q.Character != "" {
+		query += " AND `character` = ?"
+		args = append(args, q.Character)
+	}
+	query += " ORDER BY `character`"
+
+	isuList := []Isu{}
+	err := db.Select(&isuList, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	res := []TrendResponse{}
+	characterIndex := map[string]int{}
+	for _, isu := range isuList {
+		i, ok := characterIndex[isu.Character]
+		if !ok {
+			res = append(res, TrendResponse{
+				Character: isu.Character,
+				Info:      []*TrendCondition{},
+				Warning:   []*TrendCondition{},
+				Critical:  []*TrendCondition{},
+			})
+			i = len(res) - 1
+			characterIndex[isu.Character] = i
+		}
+		trend := &res[i]
+
+		isuLastCondition, ok := latestConditionStore.Get(isu.JIAIsuUUID)
+		if !ok {
+			continue
+		}
+		if _, ok := q.Levels[isuLastCondition.ConditionLevel]; !ok {
+			continue
+		}
+		timestamp := isuLastCondition.Timestamp.Unix()
+		if timestamp < q.Since {
+			continue
+		}
+
+		trendCondition := TrendCondition{
+			ID:        isu.ID,
+			Timestamp: timestamp,
+		}
+		switch isuLastCondition.ConditionLevel {
+		case conditionLevelInfo:
+			trend.Info = append(trend.Info, &trendCondition)
+		case conditionLevelWarning:
+			trend.Warning = append(trend.Warning, &trendCondition)
+		case conditionLevelCritical:
+			trend.Critical = append(trend.Critical, &trendCondition)
+		}
+	}
+
+	for i := range res {
+		res[i].Info = sortTrendConditions(res[i].Info, q.Limit)
+		res[i].Warning = sortTrendConditions(res[i].Warning, q.Limit)
+		res[i].Critical = sortTrendConditions(res[i].Critical, q.Limit)
+	}
+	return res, nil
+}
+
+// 新しい順に並べ、limit件までに切り詰める
+func sortTrendConditions(conditions []*TrendCondition, limit int) []*TrendCondition {
+	sort.Slice(conditions, func(i, j int) bool {
+		return conditions[i].Timestamp > conditions[j].Timestamp
+	})
+	if limit > 0 && len(conditions) > limit {
+		conditions = conditions[:limit]
+	}
+	return conditions
+}
+
+type trendCacheEntry struct {
+	body      []byte
+	etag      string
+	createdAt time.Time
+}
+
+// GET /api/trend のレスポンスのキャッシュ。
+// 最新のコンディションが変わると全て破棄し、それ以外の変更(ISUの登録など)はTTLで反映する
+type TrendCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	version uint64
+	entries map[string]trendCacheEntry
+}
+
+func NewTrendCache(ttl time.Duration) *TrendCache {
+	return &TrendCache{
+		ttl:     ttl,
+		entries: map[string]trendCacheEntry{},
+	}
+}
+
+// キャッシュしたレスポンスを取得。無い場合は生成してキャッシュする
+func (tc *TrendCache) Get(q TrendQuery) ([]byte, string, error) {
+	key := q.key()
+	version := latestConditionStore.Version()
+
+	tc.mu.Lock()
+	if tc.version != version {
+		tc.entries = map[string]trendCacheEntry{}
+		tc.version = version
+	}
+	entry, ok := tc.entries[key]
+	tc.mu.Unlock()
+	if ok && time.Since(entry.createdAt) < tc.ttl {
+		return entry.body, entry.etag, nil
+	}
+
+	res, err := generateTrendResponse(q)
+	if err != nil {
+		return nil, "", err
+	}
+	body, err := json.Marshal(res)
+	if err != nil {
+		return nil, "", err
+	}
+	h := fnv.New64a()
+	h.Write(body)
+	entry = trendCacheEntry{
+		body:      body,
+		etag:      fmt.Sprintf(`"%x"`, h.Sum64()),
+		createdAt: time.Now(),
+	}
+
+	tc.mu.Lock()
+	// 生成中に最新のコンディションが変わった場合は、古い内容をキャッシュしない
+	if tc.version == version && latestConditionStore.Version() == version {
+		if len(tc.entries) >= trendCacheMaxEntries {
+			tc.entries = map[string]trendCacheEntry{}
+		}
+		tc.entries[key] = entry
+	}
+	tc.mu.Unlock()
+	return entry.body, entry.etag, nil
+}
+
+// キャッシュを全て破棄する
+func (tc *TrendCache) Reset() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	tc.entries = map[string]trendCacheEntry{}
+}
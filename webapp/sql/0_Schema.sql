@@ -1,3 +1,13 @@
+-- 手で読み込んだ場合にマイグレーションで追加したテーブルが残らないよう、それらも削除する
+DROP TABLE IF EXISTS `schema_migrations`;
+DROP TABLE IF EXISTS `isu_condition_hourly`;
+DROP TABLE IF EXISTS `isu_alert_rule`;
+DROP TABLE IF EXISTS `isu_alert_delivery`;
+DROP TABLE IF EXISTS `user_session`;
+DROP TABLE IF EXISTS `isu_group`;
+DROP TABLE IF EXISTS `isu_group_member`;
+DROP TABLE IF EXISTS `isu_access`;
+DROP TABLE IF EXISTS `isu_access_invitation`;
 DROP TABLE IF EXISTS `isu_association_config`;
 DROP TABLE IF EXISTS `isu_condition`;
 DROP TABLE IF EXISTS `isu`;
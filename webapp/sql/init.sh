@@ -10,4 +10,21 @@ export MYSQL_PWD=${MYSQL_PASS:-isucon}
 export LANG="C.UTF-8"
 cd $CURRENT_DIR
 
-cat 0_Schema.sql 1_InitData.sql | mysql --defaults-file=/dev/null -h $MYSQL_HOST -P $MYSQL_PORT -u $MYSQL_USER $MYSQL_DBNAME
+# Goの実装はマイグレーションを適用したスキーマを使うので、migrateコマンドで初期化する
+# 初期状態のスナップショットも作るので、デプロイ時に一度実行しておくと POST /initialize はスナップショットから戻すだけになる
+if [ "${1:-}" = "--migrate" ]; then
+  cd ../go
+  exec ./isucondition migrate reset
+fi
+
+MYSQL="mysql --defaults-file=/dev/null -h $MYSQL_HOST -P $MYSQL_PORT -u $MYSQL_USER $MYSQL_DBNAME"
+
+# マイグレーションで追加したテーブルやschema_migrationsが残らないよう、全てのテーブルを削除してから読み込む
+(
+  echo "SET FOREIGN_KEY_CHECKS = 0;"
+  $MYSQL -N -e "SHOW TABLES" | while read -r table; do
+    echo "DROP TABLE IF EXISTS \`$table\`;"
+  done
+) | $MYSQL
+
+cat 0_Schema.sql 1_InitData.sql | $MYSQL
@@ -0,0 +1,13 @@
+CREATE TABLE `isu_condition_hourly` (
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `start_at` DATETIME NOT NULL,
+  `condition_count` INT NOT NULL,
+  `score_sum` INT NOT NULL,
+  `sitting_count` INT NOT NULL,
+  `is_broken_count` INT NOT NULL,
+  `is_dirty_count` INT NOT NULL,
+  `is_overweight_count` INT NOT NULL,
+  `timestamps` MEDIUMTEXT NOT NULL,
+  PRIMARY KEY(`jia_isu_uuid`, `start_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
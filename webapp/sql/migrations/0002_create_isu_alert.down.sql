@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `isu_alert_delivery`;
+DROP TABLE IF EXISTS `isu_alert_rule`;
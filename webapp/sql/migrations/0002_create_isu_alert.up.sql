@@ -0,0 +1,30 @@
+CREATE TABLE `isu_alert_rule` (
+  `id` bigint AUTO_INCREMENT,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `type` VARCHAR(32) NOT NULL,
+  `condition_level` VARCHAR(32) NOT NULL DEFAULT '',
+  `condition_name` VARCHAR(32) NOT NULL DEFAULT '',
+  `threshold` INT NOT NULL DEFAULT 0,
+  `webhook_url` VARCHAR(255) NOT NULL,
+  `is_triggered` TINYINT(1) NOT NULL DEFAULT 0,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  INDEX `idx_jia_isu_uuid` (`jia_isu_uuid`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `isu_alert_delivery` (
+  `id` bigint AUTO_INCREMENT,
+  `alert_rule_id` bigint NOT NULL,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `webhook_url` VARCHAR(255) NOT NULL,
+  `status` VARCHAR(32) NOT NULL,
+  `attempts` INT NOT NULL DEFAULT 0,
+  `response_status_code` INT NOT NULL DEFAULT 0,
+  `error_message` VARCHAR(255) NOT NULL DEFAULT '',
+  `payload` TEXT NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  INDEX `idx_jia_isu_uuid` (`jia_isu_uuid`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
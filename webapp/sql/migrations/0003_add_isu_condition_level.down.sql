@@ -0,0 +1,4 @@
+ALTER TABLE `isu_condition`
+  DROP INDEX `idx_jia_isu_uuid_condition_level_timestamp`,
+  DROP INDEX `idx_jia_isu_uuid_timestamp`,
+  DROP COLUMN `condition_level`;
@@ -0,0 +1,11 @@
+ALTER TABLE `isu_condition`
+  ADD COLUMN `condition_level` VARCHAR(32) NOT NULL DEFAULT '',
+  ADD INDEX `idx_jia_isu_uuid_timestamp` (`jia_isu_uuid`, `timestamp`),
+  ADD INDEX `idx_jia_isu_uuid_condition_level_timestamp` (`jia_isu_uuid`, `condition_level`, `timestamp`);
+
+UPDATE `isu_condition` SET `condition_level` =
+  CASE (`condition` LIKE '%is_dirty=true%') + (`condition` LIKE '%is_overweight=true%') + (`condition` LIKE '%is_broken=true%')
+    WHEN 0 THEN 'info'
+    WHEN 3 THEN 'critical'
+    ELSE 'warning'
+  END;
@@ -0,0 +1,4 @@
+ALTER TABLE `isu_condition`
+  DROP COLUMN `is_broken`,
+  DROP COLUMN `is_overweight`,
+  DROP COLUMN `is_dirty`;
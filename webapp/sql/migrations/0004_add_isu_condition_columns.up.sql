@@ -0,0 +1,9 @@
+ALTER TABLE `isu_condition`
+  ADD COLUMN `is_dirty` TINYINT(1) NOT NULL DEFAULT 0,
+  ADD COLUMN `is_overweight` TINYINT(1) NOT NULL DEFAULT 0,
+  ADD COLUMN `is_broken` TINYINT(1) NOT NULL DEFAULT 0;
+
+UPDATE `isu_condition` SET
+  `is_dirty` = (`condition` LIKE '%is_dirty=true%'),
+  `is_overweight` = (`condition` LIKE '%is_overweight=true%'),
+  `is_broken` = (`condition` LIKE '%is_broken=true%');
@@ -0,0 +1,2 @@
+ALTER TABLE `isu`
+  ADD COLUMN `image_hash` CHAR(64) NOT NULL DEFAULT '' AFTER `image`;
@@ -0,0 +1,2 @@
+ALTER TABLE `isu`
+  ADD COLUMN `image` LONGBLOB AFTER `name`;
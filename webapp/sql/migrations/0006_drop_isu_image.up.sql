@@ -0,0 +1,2 @@
+ALTER TABLE `isu`
+  DROP COLUMN `image`;
@@ -0,0 +1,9 @@
+CREATE TABLE `user_session` (
+  `id` CHAR(64) NOT NULL,
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `expires_at` DATETIME(6) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  INDEX `idx_jia_user_id` (`jia_user_id`),
+  INDEX `idx_expires_at` (`expires_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
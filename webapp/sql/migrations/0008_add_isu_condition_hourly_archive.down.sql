@@ -0,0 +1,7 @@
+ALTER TABLE `isu_condition_hourly`
+  DROP COLUMN `archived`,
+  DROP COLUMN `representative_timestamp`,
+  DROP COLUMN `representative_is_sitting`,
+  DROP COLUMN `representative_condition`,
+  DROP COLUMN `representative_condition_level`,
+  DROP COLUMN `representative_message`;
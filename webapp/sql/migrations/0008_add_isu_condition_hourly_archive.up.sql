@@ -0,0 +1,7 @@
+ALTER TABLE `isu_condition_hourly`
+  ADD COLUMN `archived` TINYINT(1) NOT NULL DEFAULT 0,
+  ADD COLUMN `representative_timestamp` DATETIME,
+  ADD COLUMN `representative_is_sitting` TINYINT(1) NOT NULL DEFAULT 0,
+  ADD COLUMN `representative_condition` VARCHAR(255) NOT NULL DEFAULT '',
+  ADD COLUMN `representative_condition_level` VARCHAR(32) NOT NULL DEFAULT '',
+  ADD COLUMN `representative_message` VARCHAR(255) NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+ALTER TABLE `isu_condition`
+  DROP INDEX `uniq_jia_isu_uuid_timestamp`,
+  ADD INDEX `idx_jia_isu_uuid_timestamp` (`jia_isu_uuid`, `timestamp`);
@@ -0,0 +1,8 @@
+-- 同じISUの同じタイムスタンプのコンディションは最初に書き込んだものだけを残す
+DELETE `c1` FROM `isu_condition` AS `c1`
+  JOIN `isu_condition` AS `c2`
+  ON `c1`.`jia_isu_uuid` = `c2`.`jia_isu_uuid` AND `c1`.`timestamp` = `c2`.`timestamp` AND `c1`.`id` > `c2`.`id`;
+
+ALTER TABLE `isu_condition`
+  DROP INDEX `idx_jia_isu_uuid_timestamp`,
+  ADD UNIQUE INDEX `uniq_jia_isu_uuid_timestamp` (`jia_isu_uuid`, `timestamp`);
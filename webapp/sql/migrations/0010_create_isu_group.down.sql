@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `isu_group_member`;
+DROP TABLE IF EXISTS `isu_group`;
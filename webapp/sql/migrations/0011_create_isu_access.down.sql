@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `isu_access_invitation`;
+DROP TABLE IF EXISTS `isu_access`;
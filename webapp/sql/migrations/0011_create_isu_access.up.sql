@@ -0,0 +1,23 @@
+CREATE TABLE `isu_access` (
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `role` VARCHAR(32) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`jia_isu_uuid`, `jia_user_id`),
+  INDEX `idx_jia_user_id` (`jia_user_id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `isu_access_invitation` (
+  `token` CHAR(64) NOT NULL,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `role` VARCHAR(32) NOT NULL,
+  `invited_by` VARCHAR(255) NOT NULL,
+  `accepted_by` VARCHAR(255) DEFAULT NULL,
+  `expires_at` DATETIME(6) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`token`),
+  INDEX `idx_jia_isu_uuid` (`jia_isu_uuid`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+INSERT INTO `isu_access` (`jia_isu_uuid`, `jia_user_id`, `role`)
+  SELECT `jia_isu_uuid`, `jia_user_id`, 'owner' FROM `isu`;
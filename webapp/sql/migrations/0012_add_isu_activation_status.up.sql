@@ -0,0 +1,2 @@
+ALTER TABLE `isu`
+  ADD COLUMN `activation_status` VARCHAR(16) NOT NULL DEFAULT 'active' AFTER `character`;